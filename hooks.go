@@ -1,14 +1,30 @@
 package deploy
 
 import (
+	"fmt"
+	"io"
 	"os"
 	log "github.com/Sirupsen/logrus"
+	"github.com/docker/libcompose/deploy/identity"
 	"github.com/docker/libcompose/deploy/labels"
 	"github.com/docker/libcompose/deploy/nethooks"
 	"github.com/docker/libcompose/deploy/ops"
 	"github.com/docker/libcompose/project"
 )
 
+var (
+	ErrTenantDenied       = ops.ErrTenantDenied
+	ErrNetworkDenied      = ops.ErrNetworkDenied
+	ErrPolicyDenied       = ops.ErrPolicyDenied
+	ErrPolicyNotFound     = ops.ErrPolicyNotFound
+	ErrInvalidRule        = ops.ErrInvalidRule
+	ErrInvalidOps         = ops.ErrInvalidOps
+	ErrInvalidCIDR        = ops.ErrInvalidCIDR
+	ErrMismatchedTenant   = nethooks.ErrMismatchedTenant
+	ErrBackendUnavailable = nethooks.ErrBackendUnavailable
+	ErrNoIdentity         = identity.ErrNoIdentity
+)
+
 type eventType int
 
 const (
@@ -46,47 +62,111 @@ func PopulateEnvLabels(p *project.Project, csvLabels string) error {
 	return nil
 }
 
-func PreHooks(p *project.Project, e string) error {
-	if err := ops.LoadOps(); err != nil {
-		log.Fatalf("Failed to load ops policies: %s", err)
-		os.Exit(10)
+// Options tunes the behavior of the hooks for callers embedding deploy
+type Options struct {
+	// OpsFile names the project layer of the ops policies; if empty,
+	// CONTIV_OPS_FILE or ./ops.json is used
+	OpsFile string
+
+	// Netmaster overrides the netmaster settings from the environment and ops.json
+	Netmaster nethooks.NetmasterConfig
+
+	// Identity selects how the user running the composition is found;
+	// unset fields are taken from ops.json and the environment
+	Identity identity.Config
+
+	// Plan only prints the changes an 'up' would make in netmaster;
+	// netmaster is read but nothing is posted, and the project is left
+	// untouched. Callers are expected to stop after the hooks return.
+	Plan bool
+	// PlanFormat is either "text" (default) or "json"
+	PlanFormat string
+	// PlanOutput receives the plan, os.Stdout if not set
+	PlanOutput io.Writer
+}
+
+func writePlan(p *project.Project, principal identity.Principal, opts Options) error {
+	plan, err := nethooks.PlanNetConfig(p, principal)
+	if err != nil {
 		return err
 	}
 
-	if err := nethooks.Init(); err != nil {
-		log.Fatalf("Failed to Init: %s", err)
-		os.Exit(10)
-		return err
+	w := opts.PlanOutput
+	if w == nil {
+		w = os.Stdout
+	}
+
+	switch opts.PlanFormat {
+	case "", "text":
+		return plan.WriteText(w)
+	case "json":
+		return plan.WriteJSON(w)
+	}
+
+	return fmt.Errorf("unknown plan format '%s'", opts.PlanFormat)
+}
+
+// PreHooks sets up the network configuration before the event is carried
+// out. Errors are returned rather than acted upon; they can be matched with
+// errors.Is against the errors below, or with errors.As against
+// *ops.AuthzError, and it is up to the caller to decide whether to exit.
+func PreHooks(p *project.Project, e string) error {
+	return PreHooksWithOptions(p, e, Options{})
+}
+
+func PreHooksWithOptions(p *project.Project, e string, opts Options) error {
+	if err := ops.LoadOpsFile(opts.OpsFile, p.Files...); err != nil {
+		log.Errorf("Failed to load ops policies: %s", err)
+		return fmt.Errorf("failed to load ops policies: %w", err)
+	}
+
+	principal, err := identity.Resolve(opts.Identity)
+	if err != nil {
+		return fmt.Errorf("failed to identify user: %w", err)
+	}
+
+	if opts.Plan && getEvent(e) != startEvent {
+		log.Infof("Nothing to plan for '%s'", e)
+		return nil
+	}
+
+	if err := nethooks.InitWithConfig(opts.Netmaster); err != nil {
+		log.Errorf("Failed to Init: %s", err)
+		return fmt.Errorf("failed to init: %w", err)
+	}
+
+	if opts.Plan {
+		if err := writePlan(p, principal, opts); err != nil {
+			log.Errorf("Failed to plan Network Config: %s", err)
+			return fmt.Errorf("failed to plan network config: %w", err)
+		}
+		return nil
 	}
 
 	event := getEvent(e)
 	switch event {
 	case startEvent:
-		if err := nethooks.CreateNetConfig(p); err != nil {
-			log.Fatalf("Failed to Create Network Config: %s", err)
-			os.Exit(10)
-			return err
+		if err := nethooks.CreateNetConfig(p, principal); err != nil {
+			log.Errorf("Failed to Create Network Config: %s", err)
+			return fmt.Errorf("failed to create network config: %w", err)
 		}
 	case scaleEvent:
-		if err := nethooks.ScaleNetConfig(p); err != nil {
-			log.Fatalf("Failed to Scale Network Config: %s", err)
-			os.Exit(10)
-			return err
+		if err := nethooks.ScaleNetConfig(p, principal); err != nil {
+			log.Errorf("Failed to Scale Network Config: %s", err)
+			return fmt.Errorf("failed to scale network config: %w", err)
 		}
 	case stopEvent:
 	}
 
 	switch event {
 	case startEvent, scaleEvent:
-		if err := nethooks.AutoGenLabels(p); err != nil {
-			log.Fatalf("Failed to AutoGenerate Lables: %s", err)
-			os.Exit(10)
-			return err
+		if err := nethooks.AutoGenLabels(p, principal); err != nil {
+			log.Errorf("Failed to AutoGenerate Lables: %s", err)
+			return fmt.Errorf("failed to autogenerate labels: %w", err)
 		}
 		if err := nethooks.AutoGenParams(p); err != nil {
-			log.Fatalf("Failed to AutoGenerate Params: %s", err)
-			os.Exit(10)
-			return err
+			log.Errorf("Failed to AutoGenerate Params: %s", err)
+			return fmt.Errorf("failed to autogenerate params: %w", err)
 		}
 	}
 
@@ -94,13 +174,21 @@ func PreHooks(p *project.Project, e string) error {
 }
 
 func PostHooks(p *project.Project, e string) error {
+	return PostHooksWithOptions(p, e, Options{})
+}
+
+func PostHooksWithOptions(p *project.Project, e string, opts Options) error {
 	event := getEvent(e)
 
 	switch event {
 	case startEvent:
 	case scaleEvent:
 	case stopEvent:
-		if err := nethooks.DeleteNetConfig(p); err != nil {
+		principal, err := identity.Resolve(opts.Identity)
+		if err != nil {
+			return fmt.Errorf("failed to identify user: %w", err)
+		}
+		if err := nethooks.DeleteNetConfig(p, principal); err != nil {
 			log.Debugf("Failed to Delete Netwrok Config Params: %s", err)
 			return err
 		}
@@ -0,0 +1,257 @@
+// Package identity tells who is running a composition, so that the ops
+// policies can be checked against a principal that the user can not
+// simply pick.
+package identity
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/libcompose/deploy/ops"
+)
+
+const (
+	PROVIDER_OS    = "os"
+	PROVIDER_ENV   = "env"
+	PROVIDER_TOKEN = "token"
+	PROVIDER_CERT  = "cert"
+
+	// The credentials of the user may come from the environment; the
+	// provider and what they are verified against may not
+	IDENTITY_TOKEN_FILE_ENV = "CONTIV_IDENTITY_TOKEN_FILE"
+	IDENTITY_CERT_ENV       = "CONTIV_IDENTITY_CERT"
+
+	USER_ENV_DEFAULT = "CONTIV_USER"
+	GROUPS_ENV       = "CONTIV_GROUPS"
+)
+
+var ErrNoIdentity = errors.New("Unable to identify user")
+
+// Principal is the identity the ops policies are checked against
+type Principal struct {
+	Name   string
+	Groups []string
+	// Source is the provider the principal was resolved by
+	Source string
+}
+
+// Resolver finds out who is running the composition
+type Resolver interface {
+	Resolve() (Principal, error)
+}
+
+// Config selects and sets up the identity provider. Empty fields are filled
+// from ops.json; only the token and certificate presented by the user are
+// then taken from the environment. The provider, the token key and the CA
+// bundle are set by the operator alone, so that the user can neither
+// switch providers nor bring a trust anchor of its own.
+type Config struct {
+	// Provider is one of "os" (default), "env", "token" or "cert"
+	Provider string
+	// UserEnv names the variable read by the env provider, CONTIV_USER if
+	// not set; groups are read from CONTIV_GROUPS
+	UserEnv string
+	// TokenFile holds a JWT whose 'sub' and 'groups' claims give the
+	// principal, signed with the HS256 secret or RS256 public key in
+	// TokenKeyFile
+	TokenFile    string
+	TokenKeyFile string
+	// CertFile is a client certificate whose CN names the principal and
+	// whose OUs are its groups, verified against the CA bundle in CAFile
+	CertFile string
+	CAFile   string
+}
+
+func mergeConfig(cfg *Config, provider, userEnv, tokenFile, tokenKeyFile, certFile, caFile string) {
+	if cfg.Provider == "" {
+		cfg.Provider = provider
+	}
+	if cfg.UserEnv == "" {
+		cfg.UserEnv = userEnv
+	}
+	if cfg.TokenFile == "" {
+		cfg.TokenFile = tokenFile
+	}
+	if cfg.TokenKeyFile == "" {
+		cfg.TokenKeyFile = tokenKeyFile
+	}
+	if cfg.CertFile == "" {
+		cfg.CertFile = certFile
+	}
+	if cfg.CAFile == "" {
+		cfg.CAFile = caFile
+	}
+}
+
+// GetConfig completes the passed settings from ops.json, the environment
+// and the defaults, in that order of precedence; the environment only
+// supplies the token and certificate files
+func GetConfig(cfg Config) Config {
+	opsCfg := ops.IdentityOpsGet()
+	mergeConfig(&cfg, opsCfg.Provider, opsCfg.UserEnv, opsCfg.TokenFile,
+		opsCfg.TokenKeyFile, opsCfg.CertFile, opsCfg.CAFile)
+
+	mergeConfig(&cfg, "", "", os.Getenv(IDENTITY_TOKEN_FILE_ENV), "", os.Getenv(IDENTITY_CERT_ENV), "")
+
+	if cfg.Provider == "" {
+		cfg.Provider = PROVIDER_OS
+	}
+	if cfg.UserEnv == "" {
+		cfg.UserEnv = USER_ENV_DEFAULT
+	}
+
+	return cfg
+}
+
+// NewResolver returns the resolver for the configured provider
+func NewResolver(cfg Config) (Resolver, error) {
+	switch cfg.Provider {
+	case PROVIDER_OS:
+		return OSUser{}, nil
+	case PROVIDER_ENV:
+		return EnvUser{Var: cfg.UserEnv}, nil
+	case PROVIDER_TOKEN:
+		if cfg.TokenFile == "" || cfg.TokenKeyFile == "" {
+			return nil, errors.New("token identity needs a token file and a key file")
+		}
+		return TokenUser{TokenFile: cfg.TokenFile, KeyFile: cfg.TokenKeyFile}, nil
+	case PROVIDER_CERT:
+		if cfg.CertFile == "" || cfg.CAFile == "" {
+			return nil, errors.New("certificate identity needs a certificate file and a CA bundle")
+		}
+		return CertUser{CertFile: cfg.CertFile, CAFile: cfg.CAFile}, nil
+	}
+
+	return nil, fmt.Errorf("unknown identity provider '%s'", cfg.Provider)
+}
+
+// Resolve completes the settings, then resolves the principal with the
+// configured provider
+func Resolve(cfg Config) (Principal, error) {
+	cfg = GetConfig(cfg)
+
+	r, err := NewResolver(cfg)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	principal, err := r.Resolve()
+	if err != nil {
+		log.Errorf("Unable to identify user with '%s' provider: %s", cfg.Provider, err)
+		return Principal{}, err
+	}
+	log.Debugf("Running as '%s' (%s)", principal.Name, principal.Source)
+
+	return principal, nil
+}
+
+// OSUser is the user the process runs as
+type OSUser struct{}
+
+func (OSUser) Resolve() (Principal, error) {
+	u, err := user.Current()
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: %s", ErrNoIdentity, err)
+	}
+
+	principal := Principal{Name: u.Username, Source: PROVIDER_OS}
+	gids, err := u.GroupIds()
+	if err != nil {
+		log.Debugf("Unable to list groups of '%s': %s", u.Username, err)
+		return principal, nil
+	}
+	for _, gid := range gids {
+		if g, err := user.LookupGroupId(gid); err == nil {
+			principal.Groups = append(principal.Groups, g.Name)
+		}
+	}
+
+	return principal, nil
+}
+
+// EnvUser takes the user from an environment variable, for CI jobs that
+// run as a shared account
+type EnvUser struct {
+	Var string
+}
+
+func (e EnvUser) Resolve() (Principal, error) {
+	name := strings.TrimSpace(os.Getenv(e.Var))
+	if name == "" {
+		return Principal{}, fmt.Errorf("%w: '%s' not set", ErrNoIdentity, e.Var)
+	}
+
+	return Principal{Name: name, Groups: splitList(os.Getenv(GROUPS_ENV)), Source: PROVIDER_ENV}, nil
+}
+
+// CertUser takes the user from the common name of a client certificate
+// issued by a CA of CAFile
+type CertUser struct {
+	CertFile string
+	CAFile   string
+}
+
+func (c CertUser) Resolve() (Principal, error) {
+	cert, err := readCert(c.CertFile)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	// without a CA any self-signed certificate would name any user
+	if c.CAFile == "" {
+		return Principal{}, fmt.Errorf("%w: no CA bundle to verify certificate '%s'", ErrNoIdentity, c.CertFile)
+	}
+	caData, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: unable to read CA bundle: %s", ErrNoIdentity, err)
+	}
+	opts := x509.VerifyOptions{
+		Roots:     x509.NewCertPool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if !opts.Roots.AppendCertsFromPEM(caData) {
+		return Principal{}, fmt.Errorf("%w: no certificates found in CA bundle '%s'", ErrNoIdentity, c.CAFile)
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		return Principal{}, fmt.Errorf("%w: certificate '%s': %s", ErrNoIdentity, c.CertFile, err)
+	}
+
+	if cert.Subject.CommonName == "" {
+		return Principal{}, fmt.Errorf("%w: certificate '%s' has no common name", ErrNoIdentity, c.CertFile)
+	}
+
+	return Principal{
+		Name:   cert.Subject.CommonName,
+		Groups: cert.Subject.OrganizationalUnit,
+		Source: PROVIDER_CERT,
+	}, nil
+}
+
+func readCert(fileName string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read certificate: %s", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in '%s'", fileName)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,244 @@
+package identity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/libcompose/deploy/ops"
+)
+
+func writeTmpFile(t *testing.T, dir, name string, data []byte) string {
+	fileName := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(fileName, data, 0600); err != nil {
+		t.Fatalf("error writing to tmp file %#v", err)
+	}
+	return fileName
+}
+
+func makeToken(claims, secret string) string {
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+func TestOSUser(t *testing.T) {
+	principal, err := OSUser{}.Resolve()
+	if err != nil {
+		t.Fatalf("error resolving os user: %s", err)
+	}
+	if principal.Name == "" || principal.Source != PROVIDER_OS {
+		t.Fatalf("unexpected principal %#v", principal)
+	}
+}
+
+func TestEnvUser(t *testing.T) {
+	os.Setenv("TEST_CONTIV_USER", "ci-bot")
+	os.Setenv(GROUPS_ENV, "ci, deployers")
+	defer os.Unsetenv("TEST_CONTIV_USER")
+	defer os.Unsetenv(GROUPS_ENV)
+
+	principal, err := EnvUser{Var: "TEST_CONTIV_USER"}.Resolve()
+	if err != nil {
+		t.Fatalf("error resolving env user: %s", err)
+	}
+	if principal.Name != "ci-bot" || len(principal.Groups) != 2 || principal.Groups[1] != "deployers" {
+		t.Fatalf("unexpected principal %#v", principal)
+	}
+
+	if _, err := (EnvUser{Var: "TEST_CONTIV_UNSET"}).Resolve(); !errors.Is(err, ErrNoIdentity) {
+		t.Fatalf("unset variable accepted: %v", err)
+	}
+}
+
+func TestTokenUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identity")
+	if err != nil {
+		t.Fatalf("error creating tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := writeTmpFile(t, dir, "key", []byte("s3cret\n"))
+	tokenFile := writeTmpFile(t, dir, "token",
+		[]byte(makeToken(`{"sub":"alice","groups":["dev"]}`, "s3cret")))
+
+	principal, err := TokenUser{TokenFile: tokenFile, KeyFile: keyFile}.Resolve()
+	if err != nil {
+		t.Fatalf("error resolving token user: %s", err)
+	}
+	if principal.Name != "alice" || len(principal.Groups) != 1 || principal.Source != PROVIDER_TOKEN {
+		t.Fatalf("unexpected principal %#v", principal)
+	}
+
+	writeTmpFile(t, dir, "token", []byte(makeToken(`{"sub":"alice"}`, "other")))
+	if _, err := (TokenUser{TokenFile: tokenFile, KeyFile: keyFile}).Resolve(); !errors.Is(err, ErrNoIdentity) {
+		t.Fatalf("token with a bad signature accepted: %v", err)
+	}
+
+	if _, err := verifyToken(makeToken(`{"sub":"alice","exp":1000}`, "s3cret"), []byte("s3cret"), time.Unix(2000, 0)); err == nil {
+		t.Fatalf("expired token accepted")
+	}
+	if _, err := verifyToken(makeToken(`{"groups":["dev"]}`, "s3cret"), []byte("s3cret"), time.Now()); err == nil {
+		t.Fatalf("token without subject accepted")
+	}
+}
+
+func TestTokenKeyConfusion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identity")
+	if err != nil {
+		t.Fatalf("error creating tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("error encoding key: %s", err)
+	}
+	pubPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	keyFile := writeTmpFile(t, dir, "key.pem", pubPEM)
+
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(`{"sub":"alice"}`))
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("error signing token: %s", err)
+	}
+	tokenFile := writeTmpFile(t, dir, "token", []byte(signed+"."+enc.EncodeToString(sig)))
+	if principal, err := (TokenUser{TokenFile: tokenFile, KeyFile: keyFile}).Resolve(); err != nil || principal.Name != "alice" {
+		t.Fatalf("RS256 token not accepted: %v %v", principal, err)
+	}
+
+	// an HS256 token keyed with the public key must not pass
+	writeTmpFile(t, dir, "token", []byte(makeToken(`{"sub":"admin"}`, strings.TrimSpace(string(pubPEM)))))
+	if _, err := (TokenUser{TokenFile: tokenFile, KeyFile: keyFile}).Resolve(); !errors.Is(err, ErrNoIdentity) {
+		t.Fatalf("HS256 token accepted with an RS256 key: %v", err)
+	}
+
+	// nor an RS256 header with a shared secret
+	if _, err := verifyToken(signed+"."+enc.EncodeToString(sig), []byte("s3cret"), time.Now()); err == nil {
+		t.Fatalf("RS256 token accepted with an HS256 secret")
+	}
+}
+
+func TestCertUser(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identity")
+	if err != nil {
+		t.Fatalf("error creating tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "bob", OrganizationalUnit: []string{"ops"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %s", err)
+	}
+	certFile := writeTmpFile(t, dir, "cert.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+
+	principal, err := CertUser{CertFile: certFile, CAFile: certFile}.Resolve()
+	if err != nil {
+		t.Fatalf("error resolving cert user: %s", err)
+	}
+	if principal.Name != "bob" || len(principal.Groups) != 1 || principal.Groups[0] != "ops" {
+		t.Fatalf("unexpected principal %#v", principal)
+	}
+
+	if _, err := (CertUser{CertFile: certFile}).Resolve(); !errors.Is(err, ErrNoIdentity) {
+		t.Fatalf("certificate accepted without a CA bundle: %v", err)
+	}
+
+	// a CA that did not sign the certificate
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherDer, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &otherKey.PublicKey, otherKey)
+	if err != nil {
+		t.Fatalf("error creating certificate: %s", err)
+	}
+	caFile := writeTmpFile(t, dir, "ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: otherDer}))
+	if _, err := (CertUser{CertFile: certFile, CAFile: caFile}).Resolve(); !errors.Is(err, ErrNoIdentity) {
+		t.Fatalf("certificate from an unknown CA accepted: %v", err)
+	}
+}
+
+func TestGetConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "identity")
+	if err != nil {
+		t.Fatalf("error creating tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opsFile := writeTmpFile(t, dir, "ops.json",
+		[]byte(`{ "Identity": { "Provider": "env", "UserEnv": "CI_USER" } }`))
+	if err := ops.LoadOpsFile(opsFile); err != nil {
+		t.Fatalf("error loading ops file: %s", err)
+	}
+	// the environment can not pick the provider nor what it trusts
+	os.Setenv("CONTIV_IDENTITY_PROVIDER", PROVIDER_ENV)
+	os.Setenv("CONTIV_IDENTITY_TOKEN_KEY_FILE", "/tmp/key")
+	os.Setenv("CONTIV_IDENTITY_CA_CERT", "/tmp/ca.pem")
+	defer os.Unsetenv("CONTIV_IDENTITY_PROVIDER")
+	defer os.Unsetenv("CONTIV_IDENTITY_TOKEN_KEY_FILE")
+	defer os.Unsetenv("CONTIV_IDENTITY_CA_CERT")
+
+	// ops.json wins over the environment
+	if cfg := GetConfig(Config{}); cfg.Provider != PROVIDER_ENV || cfg.UserEnv != "CI_USER" {
+		t.Fatalf("unexpected config %#v", cfg)
+	}
+	// explicit settings win over ops.json
+	if cfg := GetConfig(Config{Provider: PROVIDER_OS}); cfg.Provider != PROVIDER_OS {
+		t.Fatalf("unexpected config %#v", cfg)
+	}
+
+	writeTmpFile(t, dir, "ops.json", []byte(`{}`))
+	if err := ops.LoadOpsFile(opsFile); err != nil {
+		t.Fatalf("error loading ops file: %s", err)
+	}
+	if cfg := GetConfig(Config{}); cfg.Provider != PROVIDER_OS || cfg.UserEnv != USER_ENV_DEFAULT ||
+		cfg.TokenKeyFile != "" || cfg.CAFile != "" {
+		t.Fatalf("unexpected config %#v", cfg)
+	}
+
+	if _, err := NewResolver(Config{Provider: "kerberos"}); err == nil {
+		t.Fatalf("unknown provider accepted")
+	}
+	if _, err := NewResolver(Config{Provider: PROVIDER_TOKEN}); err == nil {
+		t.Fatalf("token provider without files accepted")
+	}
+	if _, err := NewResolver(Config{Provider: PROVIDER_CERT, CertFile: "cert.pem"}); err == nil {
+		t.Fatalf("cert provider without a CA bundle accepted")
+	}
+}
@@ -0,0 +1,137 @@
+package identity
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// TokenUser takes the user from a signed JWT, as handed out to CI jobs by
+// the identity provider
+type TokenUser struct {
+	TokenFile string
+	// KeyFile holds either the HS256 secret or a PEM RS256 public key; the
+	// token must be signed with the algorithm of the key
+	KeyFile string
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+}
+
+type tokenClaims struct {
+	Sub    string   `json:"sub"`
+	Groups []string `json:"groups"`
+	Exp    int64    `json:"exp"`
+	Nbf    int64    `json:"nbf"`
+}
+
+func (t TokenUser) Resolve() (Principal, error) {
+	tokenData, err := ioutil.ReadFile(t.TokenFile)
+	if err != nil {
+		return Principal{}, fmt.Errorf("unable to read token: %s", err)
+	}
+	keyData, err := ioutil.ReadFile(t.KeyFile)
+	if err != nil {
+		return Principal{}, fmt.Errorf("unable to read token key: %s", err)
+	}
+
+	claims, err := verifyToken(strings.TrimSpace(string(tokenData)), keyData, time.Now())
+	if err != nil {
+		return Principal{}, fmt.Errorf("%w: token '%s': %s", ErrNoIdentity, t.TokenFile, err)
+	}
+
+	return Principal{Name: claims.Sub, Groups: claims.Groups, Source: PROVIDER_TOKEN}, nil
+}
+
+func verifyToken(token string, key []byte, now time.Time) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	header := tokenHeader{}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed signature: %s", err)
+	}
+
+	// the key, not the token, decides the algorithm: a PEM key is an RS256
+	// public key, anything else an HS256 secret. Otherwise a token HMAC
+	// signed with the public key would pass as HS256.
+	signed := []byte(parts[0] + "." + parts[1])
+	if block, _ := pem.Decode(key); block != nil {
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("signing algorithm '%s' does not match the RS256 key", header.Alg)
+		}
+		pubKey, err := parseRSAPublicKey(block)
+		if err != nil {
+			return nil, err
+		}
+		digest := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(pubKey, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, errors.New("bad signature")
+		}
+	} else {
+		if header.Alg != "HS256" {
+			return nil, fmt.Errorf("signing algorithm '%s' does not match the HS256 secret", header.Alg)
+		}
+		mac := hmac.New(sha256.New, []byte(strings.TrimSpace(string(key))))
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, errors.New("bad signature")
+		}
+	}
+
+	claims := &tokenClaims{}
+	if err := decodeSegment(parts[1], claims); err != nil {
+		return nil, err
+	}
+	if claims.Exp != 0 && now.Unix() >= claims.Exp {
+		return nil, errors.New("expired")
+	}
+	if claims.Nbf != 0 && now.Unix() < claims.Nbf {
+		return nil, errors.New("not yet valid")
+	}
+	if claims.Sub == "" {
+		return nil, errors.New("no subject")
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("malformed token: %s", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("malformed token: %s", err)
+	}
+	return nil
+}
+
+func parseRSAPublicKey(block *pem.Block) (*rsa.PublicKey, error) {
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %s", err)
+	}
+	rsaKey, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an RSA key")
+	}
+	return rsaKey, nil
+}
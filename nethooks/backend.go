@@ -0,0 +1,67 @@
+package nethooks
+
+import (
+	"sync"
+
+	contivClient "github.com/contiv/contivmodel/client"
+)
+
+// PolicyBackend is the store the network objects of a composition are
+// programmed into. The contiv netmaster client implements it as is; the
+// method set mirrors its tenant, network, epg, policy, rule and app-profile
+// calls so other implementations can be dropped in for testing.
+type PolicyBackend interface {
+	TenantPost(obj *contivClient.Tenant) error
+	TenantGet(tenantName string) (*contivClient.Tenant, error)
+	TenantList() (*[]*contivClient.Tenant, error)
+	TenantDelete(tenantName string) error
+
+	NetworkPost(obj *contivClient.Network) error
+	NetworkGet(tenantName, networkName string) (*contivClient.Network, error)
+	NetworkList() (*[]*contivClient.Network, error)
+	NetworkDelete(tenantName, networkName string) error
+
+	EndpointGroupPost(obj *contivClient.EndpointGroup) error
+	EndpointGroupGet(tenantName, networkName, groupName string) (*contivClient.EndpointGroup, error)
+	EndpointGroupList() (*[]*contivClient.EndpointGroup, error)
+	EndpointGroupDelete(tenantName, networkName, groupName string) error
+
+	PolicyPost(obj *contivClient.Policy) error
+	PolicyGet(tenantName, policyName string) (*contivClient.Policy, error)
+	PolicyList() (*[]*contivClient.Policy, error)
+	PolicyDelete(tenantName, policyName string) error
+
+	RulePost(obj *contivClient.Rule) error
+	RuleGet(tenantName, policyName, ruleID string) (*contivClient.Rule, error)
+	RuleList() (*[]*contivClient.Rule, error)
+	RuleDelete(tenantName, policyName, ruleID string) error
+
+	AppProfilePost(obj *contivClient.AppProfile) error
+	AppProfileGet(tenantName, networkName, appProfileName string) (*contivClient.AppProfile, error)
+	AppProfileList() (*[]*contivClient.AppProfile, error)
+	AppProfileDelete(tenantName, networkName, appProfileName string) error
+}
+
+var _ PolicyBackend = (*contivClient.ContivClient)(nil)
+
+var backend PolicyBackend
+
+// backendMu is held by CreateNetConfig, DeleteNetConfig and PlanNetConfig
+// for as long as they run, as they install a journaling or recording
+// backend in place of the one set; calls from several goroutines run one
+// at a time.
+var backendMu sync.Mutex
+
+// SetBackend selects the backend used by CreateNetConfig and DeleteNetConfig
+func SetBackend(b PolicyBackend) {
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	backend = b
+}
+
+// GetBackend returns the backend currently in use
+func GetBackend() PolicyBackend {
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	return backend
+}
@@ -0,0 +1,252 @@
+package nethooks
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/libcompose/config"
+	"github.com/docker/libcompose/deploy/identity"
+	"github.com/docker/libcompose/deploy/ops"
+	"github.com/docker/libcompose/project"
+)
+
+// getLabelContractRules returns the rules of the contract the labels of a
+// consumer hold with a provider, nil if there is none. Rules are written as
+// in ops.json and separated by ';', e.g. "permit tcp/6379,6380; deny all".
+func getLabelContractRules(fromSvcName string, fromSvc *config.ServiceConfig, toSvcName string) ([]ops.Rule, error) {
+	labels := fromSvc.Labels.MapParts()
+	value, ok := labels[CONTRACT_LABEL_PREFIX+toSvcName]
+	if !ok {
+		return nil, nil
+	}
+
+	ruleStrs := []string{}
+	for _, rule := range strings.Split(value, ";") {
+		if rule = strings.TrimSpace(rule); rule != "" {
+			ruleStrs = append(ruleStrs, rule)
+		}
+	}
+	if len(ruleStrs) == 0 {
+		return nil, fmt.Errorf("%w: no rules in label '%s' of service '%s'",
+			ops.ErrInvalidRule, CONTRACT_LABEL_PREFIX+toSvcName, fromSvcName)
+	}
+
+	return ops.ParseRules(ops.ContractName(fromSvcName, toSvcName), ruleStrs)
+}
+
+// getContractProviders returns the services a consumer of a project holds
+// a contract with, in ops.json or in its labels
+func getContractProviders(projectName, svcName string, svc *config.ServiceConfig) []string {
+	providers := ops.GetContractProviders(projectName, svcName)
+	for key := range svc.Labels.MapParts() {
+		if strings.HasPrefix(key, CONTRACT_LABEL_PREFIX) {
+			providers = append(providers, strings.TrimPrefix(key, CONTRACT_LABEL_PREFIX))
+		}
+	}
+	sort.Strings(providers)
+	return providers
+}
+
+// permitsPort tells whether the first of the rules matching a port permits
+// it; port 0 stands for every port of the protocol
+func permitsPort(rules []portRule, proto string, port int) bool {
+	for _, rule := range rules {
+		if rule.proto != proto && rule.proto != "all" {
+			continue
+		}
+		if rule.port == 0 {
+			return rule.action == "permit"
+		}
+		if port == 0 {
+			// a single port decides nothing for all of them, unless denied
+			if rule.action == "deny" {
+				return false
+			}
+			continue
+		}
+		if rule.port == port {
+			return rule.action == "permit"
+		}
+	}
+	return false
+}
+
+// narrows checks that rules permit nothing the base rules do not; it
+// returns the first rule that does
+func narrows(rules, base []ops.Rule) (portRule, bool) {
+	baseRules := expandRules(base)
+	for _, rule := range expandRules(rules) {
+		if rule.action != "permit" {
+			continue
+		}
+		if rule.proto == "all" {
+			if !allowsAll(base) {
+				return rule, false
+			}
+			continue
+		}
+		if !permitsPort(baseRules, rule.proto, rule.port) {
+			return rule, false
+		}
+	}
+	return portRule{}, true
+}
+
+// getLinkPolicyRules returns the rules of the policy a consumer selects in
+// its labels for the traffic to a provider, nil if it selects none; the
+// policy may only narrow the policy of the provider
+func getLinkPolicyRules(principal identity.Principal, fromSvcName string, fromSvc *config.ServiceConfig, toSvcName string, toSvc *config.ServiceConfig) ([]ops.Rule, error) {
+	policyName, ok := fromSvc.Labels.MapParts()[LINK_POLICY_LABEL_PREFIX+toSvcName]
+	if !ok {
+		return nil, nil
+	}
+
+	if err := ops.UserOpsCheckNetworkPolicy(principal.Name, policyName, principal.Groups...); err != nil {
+		log.Errorf("User '%s' not allowed to use policy '%s'", principal.Name, policyName)
+		return nil, err
+	}
+	policyRules, err := ops.GetRules(policyName)
+	if err != nil {
+		log.Errorf("Unable to get rules for policy '%s': %s", policyName, err)
+		return nil, err
+	}
+
+	if policyRules, err = expandAppRules(toSvc, policyRules); err != nil {
+		return nil, err
+	}
+	svcRules, err := getServiceRules(principal, toSvcName, toSvc)
+	if err != nil {
+		return nil, err
+	}
+	linkName := ops.ContractName(fromSvcName, toSvcName)
+	if err := checkNarrows(principal, "link", linkName, toSvcName, policyRules, svcRules); err != nil {
+		return nil, err
+	}
+
+	log.Infof("User '%s': applying '%s' to link '%s'", principal.Name, policyName, linkName)
+	return policyRules, nil
+}
+
+// getLinkBaseRules returns the rules of the traffic from a consumer to a
+// provider without contracts: those of the policy the consumer selects for
+// the link in its labels if any, else the rules of the provider's policy. It
+// tells whether the rules come from the labels.
+func getLinkBaseRules(principal identity.Principal, fromSvcName string, fromSvc *config.ServiceConfig, toSvcName string, toSvc *config.ServiceConfig) ([]ops.Rule, bool, error) {
+	rules, err := getLinkPolicyRules(principal, fromSvcName, fromSvc, toSvcName, toSvc)
+	if err != nil || rules != nil {
+		return rules, rules != nil, err
+	}
+	rules, err = getServiceRules(principal, toSvcName, toSvc)
+	return rules, false, err
+}
+
+// checkNarrows refuses the rules of a contract or link policy that permit
+// more than the base rules
+func checkNarrows(principal identity.Principal, resource, name, toSvcName string, rules, base []ops.Rule) error {
+	rule, ok := narrows(rules, base)
+	if ok {
+		return nil
+	}
+	port := "any"
+	if rule.port != 0 {
+		port = strconv.Itoa(rule.port)
+	}
+	log.Errorf("The %s '%s' permits %s/%s beyond the policy of '%s'", resource, name, rule.proto, port, toSvcName)
+	return &ops.AuthzError{User: principal.Name, Resource: resource, Name: name, Err: ops.ErrPolicyDenied}
+}
+
+// getLinkRules returns the ordered rules of the traffic from a consumer to
+// a provider: those of the contract of ops.json between them if any, else
+// those of the policy the consumer selects for the link in its labels, else
+// the rules of the provider's policy. A contract of the user or project
+// layers, or in the labels of the consumer, replaces these but may only
+// narrow them; one of the system or team layers is applied as is. It tells
+// whether the rules come from the labels, to be applied in the override
+// band.
+func getLinkRules(p *project.Project, principal identity.Principal, fromSvcName, toSvcName string) ([]ops.Rule, bool, error) {
+	fromSvc, _ := p.Configs.Get(fromSvcName)
+	toSvc, _ := p.Configs.Get(toSvcName)
+	contractName := ops.ContractName(fromSvcName, toSvcName)
+
+	rules, err := ops.GetContractRules(p.Name, fromSvcName, toSvcName)
+	if err != nil {
+		log.Errorf("Unable to get rules for contract '%s': %s", contractName, err)
+		return nil, false, err
+	}
+	override := false
+	if rules != nil {
+		if rules, err = expandAppRules(toSvc, rules); err != nil {
+			return nil, false, err
+		}
+		if origin, _ := ops.ContractOrigin(p.Name, fromSvcName, toSvcName); !origin.Trusted() {
+			base, _, err := getLinkBaseRules(principal, fromSvcName, fromSvc, toSvcName, toSvc)
+			if err != nil {
+				return nil, false, err
+			}
+			if err := checkNarrows(principal, "contract", contractName, toSvcName, rules, base); err != nil {
+				return nil, false, err
+			}
+		} else if _, ok := fromSvc.Labels.MapParts()[LINK_POLICY_LABEL_PREFIX+toSvcName]; ok {
+			log.Infof("Ignoring the policy of link '%s' in favor of its contract", contractName)
+		}
+		log.Infof("User '%s': applying contract '%s'", principal.Name, contractName)
+	} else {
+		rules, override, err = getLinkBaseRules(principal, fromSvcName, fromSvc, toSvcName, toSvc)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	labelRules, err := getLabelContractRules(fromSvcName, fromSvc, toSvcName)
+	if err != nil || labelRules == nil {
+		return rules, override, err
+	}
+	labelRules, err = expandAppRules(toSvc, labelRules)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := checkNarrows(principal, "contract", contractName, toSvcName, labelRules, rules); err != nil {
+		return nil, false, err
+	}
+
+	log.Infof("User '%s': applying contract '%s' from labels", principal.Name, contractName)
+	return labelRules, true, nil
+}
+
+// isProviderRestricted tells whether some traffic to a provider is to be
+// denied, by its policy or by the rules of one of its links, in which case
+// consumers allowed everything need rules of their own
+func isProviderRestricted(p *project.Project, principal identity.Principal, toSvcName string) (bool, error) {
+	toSvc, _ := p.Configs.Get(toSvcName)
+	rules, err := getServiceRules(principal, toSvcName, toSvc)
+	if err != nil {
+		return false, err
+	}
+	if !allowsAll(rules) {
+		return true, nil
+	}
+
+	links, err := getSvcLinks(p)
+	if err != nil {
+		return false, err
+	}
+	for _, fromSvcName := range p.Configs.Keys() {
+		for _, provider := range links[fromSvcName] {
+			if provider != toSvcName {
+				continue
+			}
+			rules, _, err := getLinkRules(p, principal, fromSvcName, toSvcName)
+			if err != nil {
+				return false, err
+			}
+			if !allowsAll(rules) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
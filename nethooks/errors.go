@@ -0,0 +1,11 @@
+package nethooks
+
+import (
+	"errors"
+)
+
+var (
+	ErrMismatchedTenant   = errors.New("mismatching tenants")
+	ErrBackendUnavailable = errors.New("policy backend unavailable")
+	ErrInvalidPort        = errors.New("invalid published port")
+)
@@ -0,0 +1,236 @@
+package nethooks
+
+import (
+	log "github.com/Sirupsen/logrus"
+	contivClient "github.com/contiv/contivmodel/client"
+)
+
+type undoRec struct {
+	desc string
+	undo func() error
+}
+
+// txBackend passes everything through to the wrapped backend and journals
+// how to revert each post and delete, so a failed run can be rolled back
+type txBackend struct {
+	PolicyBackend
+	journal []undoRec
+}
+
+func newTxBackend(b PolicyBackend) *txBackend {
+	return &txBackend{PolicyBackend: b}
+}
+
+func (tx *txBackend) record(desc string, undo func() error) {
+	log.Debugf("Journaled '%s'", desc)
+	tx.journal = append(tx.journal, undoRec{desc: desc, undo: undo})
+}
+
+// rollback reverts the journaled changes, newest first. It keeps going when
+// an undo fails and returns the first error seen.
+func (tx *txBackend) rollback() error {
+	var firstErr error
+
+	for idx := len(tx.journal) - 1; idx >= 0; idx-- {
+		rec := tx.journal[idx]
+		log.Infof("Rolling back '%s'", rec.desc)
+		if err := rec.undo(); err != nil {
+			log.Errorf("Unable to roll back '%s'. Error %v", rec.desc, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	tx.journal = nil
+
+	return firstErr
+}
+
+func (tx *txBackend) TenantPost(obj *contivClient.Tenant) error {
+	old, getErr := tx.PolicyBackend.TenantGet(obj.TenantName)
+	if err := tx.PolicyBackend.TenantPost(obj); err != nil {
+		return err
+	}
+	if getErr == nil {
+		tx.record("update tenant "+obj.TenantName, func() error { return tx.PolicyBackend.TenantPost(old) })
+	} else {
+		tx.record("create tenant "+obj.TenantName, func() error { return tx.PolicyBackend.TenantDelete(obj.TenantName) })
+	}
+	return nil
+}
+
+func (tx *txBackend) TenantDelete(tenantName string) error {
+	old, err := tx.PolicyBackend.TenantGet(tenantName)
+	if err != nil {
+		return err
+	}
+	if err := tx.PolicyBackend.TenantDelete(tenantName); err != nil {
+		return err
+	}
+	tx.record("delete tenant "+tenantName, func() error { return tx.PolicyBackend.TenantPost(old) })
+	return nil
+}
+
+func (tx *txBackend) NetworkPost(obj *contivClient.Network) error {
+	old, getErr := tx.PolicyBackend.NetworkGet(obj.TenantName, obj.NetworkName)
+	if err := tx.PolicyBackend.NetworkPost(obj); err != nil {
+		return err
+	}
+	if getErr == nil {
+		tx.record("update network "+obj.NetworkName, func() error { return tx.PolicyBackend.NetworkPost(old) })
+	} else {
+		tx.record("create network "+obj.NetworkName, func() error {
+			return tx.PolicyBackend.NetworkDelete(obj.TenantName, obj.NetworkName)
+		})
+	}
+	return nil
+}
+
+func (tx *txBackend) NetworkDelete(tenantName, networkName string) error {
+	old, err := tx.PolicyBackend.NetworkGet(tenantName, networkName)
+	if err != nil {
+		return err
+	}
+	if err := tx.PolicyBackend.NetworkDelete(tenantName, networkName); err != nil {
+		return err
+	}
+	tx.record("delete network "+networkName, func() error { return tx.PolicyBackend.NetworkPost(old) })
+	return nil
+}
+
+func (tx *txBackend) EndpointGroupPost(obj *contivClient.EndpointGroup) error {
+	old, getErr := tx.PolicyBackend.EndpointGroupGet(obj.TenantName, obj.NetworkName, obj.GroupName)
+	if err := tx.PolicyBackend.EndpointGroupPost(obj); err != nil {
+		return err
+	}
+	if getErr == nil {
+		tx.record("update epg "+obj.GroupName, func() error { return tx.PolicyBackend.EndpointGroupPost(old) })
+	} else {
+		tx.record("create epg "+obj.GroupName, func() error {
+			return tx.PolicyBackend.EndpointGroupDelete(obj.TenantName, obj.NetworkName, obj.GroupName)
+		})
+	}
+	return nil
+}
+
+func (tx *txBackend) EndpointGroupDelete(tenantName, networkName, groupName string) error {
+	old, err := tx.PolicyBackend.EndpointGroupGet(tenantName, networkName, groupName)
+	if err != nil {
+		return err
+	}
+	if err := tx.PolicyBackend.EndpointGroupDelete(tenantName, networkName, groupName); err != nil {
+		return err
+	}
+	tx.record("delete epg "+groupName, func() error { return tx.PolicyBackend.EndpointGroupPost(old) })
+	return nil
+}
+
+func (tx *txBackend) PolicyPost(obj *contivClient.Policy) error {
+	old, getErr := tx.PolicyBackend.PolicyGet(obj.TenantName, obj.PolicyName)
+	if err := tx.PolicyBackend.PolicyPost(obj); err != nil {
+		return err
+	}
+	if getErr == nil {
+		tx.record("update policy "+obj.PolicyName, func() error { return tx.PolicyBackend.PolicyPost(old) })
+	} else {
+		tx.record("create policy "+obj.PolicyName, func() error {
+			return tx.PolicyBackend.PolicyDelete(obj.TenantName, obj.PolicyName)
+		})
+	}
+	return nil
+}
+
+// PolicyDelete also journals the rules of the policy, as they are removed
+// along with it
+func (tx *txBackend) PolicyDelete(tenantName, policyName string) error {
+	old, err := tx.PolicyBackend.PolicyGet(tenantName, policyName)
+	if err != nil {
+		return err
+	}
+	allRules, err := tx.PolicyBackend.RuleList()
+	if err != nil {
+		return err
+	}
+	rules := []*contivClient.Rule{}
+	for _, rule := range *allRules {
+		if rule.TenantName == tenantName && rule.PolicyName == policyName {
+			rules = append(rules, rule)
+		}
+	}
+
+	if err := tx.PolicyBackend.PolicyDelete(tenantName, policyName); err != nil {
+		return err
+	}
+	tx.record("delete policy "+policyName, func() error {
+		if err := tx.PolicyBackend.PolicyPost(old); err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			if err := tx.PolicyBackend.RulePost(rule); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return nil
+}
+
+func (tx *txBackend) RulePost(obj *contivClient.Rule) error {
+	old, getErr := tx.PolicyBackend.RuleGet(obj.TenantName, obj.PolicyName, obj.RuleID)
+	if err := tx.PolicyBackend.RulePost(obj); err != nil {
+		return err
+	}
+	desc := obj.PolicyName + "/" + obj.RuleID
+	if getErr == nil {
+		tx.record("update rule "+desc, func() error {
+			if err := tx.PolicyBackend.RuleDelete(obj.TenantName, obj.PolicyName, obj.RuleID); err != nil {
+				return err
+			}
+			return tx.PolicyBackend.RulePost(old)
+		})
+	} else {
+		tx.record("create rule "+desc, func() error {
+			return tx.PolicyBackend.RuleDelete(obj.TenantName, obj.PolicyName, obj.RuleID)
+		})
+	}
+	return nil
+}
+
+func (tx *txBackend) RuleDelete(tenantName, policyName, ruleID string) error {
+	old, err := tx.PolicyBackend.RuleGet(tenantName, policyName, ruleID)
+	if err != nil {
+		return err
+	}
+	if err := tx.PolicyBackend.RuleDelete(tenantName, policyName, ruleID); err != nil {
+		return err
+	}
+	tx.record("delete rule "+policyName+"/"+ruleID, func() error { return tx.PolicyBackend.RulePost(old) })
+	return nil
+}
+
+func (tx *txBackend) AppProfilePost(obj *contivClient.AppProfile) error {
+	old, getErr := tx.PolicyBackend.AppProfileGet(obj.TenantName, obj.NetworkName, obj.AppProfileName)
+	if err := tx.PolicyBackend.AppProfilePost(obj); err != nil {
+		return err
+	}
+	if getErr == nil {
+		tx.record("update app "+obj.AppProfileName, func() error { return tx.PolicyBackend.AppProfilePost(old) })
+	} else {
+		tx.record("create app "+obj.AppProfileName, func() error {
+			return tx.PolicyBackend.AppProfileDelete(obj.TenantName, obj.NetworkName, obj.AppProfileName)
+		})
+	}
+	return nil
+}
+
+func (tx *txBackend) AppProfileDelete(tenantName, networkName, appProfileName string) error {
+	old, err := tx.PolicyBackend.AppProfileGet(tenantName, networkName, appProfileName)
+	if err != nil {
+		return err
+	}
+	if err := tx.PolicyBackend.AppProfileDelete(tenantName, networkName, appProfileName); err != nil {
+		return err
+	}
+	tx.record("delete app "+appProfileName, func() error { return tx.PolicyBackend.AppProfilePost(old) })
+	return nil
+}
@@ -0,0 +1,97 @@
+package nethooks
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	contivClient "github.com/contiv/contivmodel/client"
+)
+
+// failingBackend fails the n-th rule post
+type failingBackend struct {
+	*MemBackend
+	failAt    int
+	rulePosts int
+}
+
+func (b *failingBackend) RulePost(obj *contivClient.Rule) error {
+	b.rulePosts++
+	if b.rulePosts == b.failAt {
+		return errors.New("injected failure")
+	}
+	return b.MemBackend.RulePost(obj)
+}
+
+type memSnapshot struct {
+	epgs     []*contivClient.EndpointGroup
+	policies []*contivClient.Policy
+	rules    []*contivClient.Rule
+	apps     []*contivClient.AppProfile
+}
+
+func snapshot(b *MemBackend) memSnapshot {
+	epgs, _ := b.EndpointGroupList()
+	policies, _ := b.PolicyList()
+	rules, _ := b.RuleList()
+	apps, _ := b.AppProfileList()
+	return memSnapshot{*epgs, *policies, *rules, *apps}
+}
+
+func TestRollbackOnCreate(t *testing.T) {
+	loadTestOps(t, testOps)
+
+	b := &failingBackend{MemBackend: NewMemBackend(), failAt: 3}
+	SetBackend(b)
+	defer SetBackend(nil)
+
+	if err := CreateNetConfig(newTestProject(t, testCompose), testPrincipal); err == nil {
+		t.Fatalf("injected failure not reported")
+	}
+
+	s := snapshot(b.MemBackend)
+	if len(s.epgs) != 0 || len(s.policies) != 0 || len(s.rules) != 0 || len(s.apps) != 0 {
+		t.Fatalf("objects left behind after a failed create: %#v", s)
+	}
+}
+
+func TestRollbackOnUpdate(t *testing.T) {
+	loadTestOps(t, testOps)
+
+	b := &failingBackend{MemBackend: NewMemBackend()}
+	SetBackend(b)
+	defer SetBackend(nil)
+
+	if err := CreateNetConfig(newTestProject(t, testCompose), testPrincipal); err != nil {
+		t.Fatalf("Unable to create net config. Error %v", err)
+	}
+	before := snapshot(b.MemBackend)
+
+	b.rulePosts = 0
+	b.failAt = 2
+	err := CreateNetConfig(newTestProject(t, `
+            web:
+              image: web
+              ports:
+               - "5000:5000"
+               - "5001:5001"
+              links:
+               - redis
+            worker:
+              image: worker
+              links:
+               - redis
+            redis:
+              image: redis
+              labels:
+                io.contiv.policy: "RedisSingle"
+            `), testPrincipal)
+	if err == nil {
+		t.Fatalf("injected failure not reported")
+	}
+
+	after := snapshot(b.MemBackend)
+	if !reflect.DeepEqual(before, after) {
+		t.Fatalf("state not restored after a failed update:\nbefore %#v\nafter  %#v", before, after)
+	}
+}
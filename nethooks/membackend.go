@@ -0,0 +1,407 @@
+package nethooks
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	contivClient "github.com/contiv/contivmodel/client"
+)
+
+// MemBackend is an in-memory PolicyBackend. Objects are keyed the same way
+// netmaster keys them and the references between policies, rules, epgs and
+// app profiles are checked on post and delete, so a translation that works
+// against it is expected to work against netmaster.
+type MemBackend struct {
+	mu             sync.Mutex
+	tenants        map[string]*contivClient.Tenant
+	networks       map[string]*contivClient.Network
+	endpointGroups map[string]*contivClient.EndpointGroup
+	policies       map[string]*contivClient.Policy
+	rules          map[string]*contivClient.Rule
+	appProfiles    map[string]*contivClient.AppProfile
+}
+
+// NewMemBackend returns an empty in-memory backend
+func NewMemBackend() *MemBackend {
+	return &MemBackend{
+		tenants:        make(map[string]*contivClient.Tenant),
+		networks:       make(map[string]*contivClient.Network),
+		endpointGroups: make(map[string]*contivClient.EndpointGroup),
+		policies:       make(map[string]*contivClient.Policy),
+		rules:          make(map[string]*contivClient.Rule),
+		appProfiles:    make(map[string]*contivClient.AppProfile),
+	}
+}
+
+func memKey(parts ...string) string {
+	return strings.Join(parts, ":")
+}
+
+func sortedKeys(keys []string) []string {
+	sort.Strings(keys)
+	return keys
+}
+
+func copyTenant(obj *contivClient.Tenant) *contivClient.Tenant {
+	c := *obj
+	return &c
+}
+
+func copyNetwork(obj *contivClient.Network) *contivClient.Network {
+	c := *obj
+	return &c
+}
+
+func copyEpg(obj *contivClient.EndpointGroup) *contivClient.EndpointGroup {
+	c := *obj
+	c.Policies = append([]string{}, obj.Policies...)
+	return &c
+}
+
+func copyPolicy(obj *contivClient.Policy) *contivClient.Policy {
+	c := *obj
+	return &c
+}
+
+func copyRule(obj *contivClient.Rule) *contivClient.Rule {
+	c := *obj
+	return &c
+}
+
+func copyApp(obj *contivClient.AppProfile) *contivClient.AppProfile {
+	c := *obj
+	c.EndpointGroups = append([]string{}, obj.EndpointGroups...)
+	return &c
+}
+
+func (b *MemBackend) TenantPost(obj *contivClient.Tenant) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := memKey(obj.TenantName)
+	b.tenants[key] = copyTenant(obj)
+	b.tenants[key].Key = key
+	return nil
+}
+
+func (b *MemBackend) TenantGet(tenantName string) (*contivClient.Tenant, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	obj, ok := b.tenants[memKey(tenantName)]
+	if !ok {
+		return nil, fmt.Errorf("tenant '%s' not found", tenantName)
+	}
+	return copyTenant(obj), nil
+}
+
+func (b *MemBackend) TenantList() (*[]*contivClient.Tenant, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	keys := []string{}
+	for key := range b.tenants {
+		keys = append(keys, key)
+	}
+	list := []*contivClient.Tenant{}
+	for _, key := range sortedKeys(keys) {
+		list = append(list, copyTenant(b.tenants[key]))
+	}
+	return &list, nil
+}
+
+func (b *MemBackend) TenantDelete(tenantName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := memKey(tenantName)
+	if _, ok := b.tenants[key]; !ok {
+		return fmt.Errorf("tenant '%s' not found", tenantName)
+	}
+	delete(b.tenants, key)
+	return nil
+}
+
+func (b *MemBackend) NetworkPost(obj *contivClient.Network) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := memKey(obj.TenantName, obj.NetworkName)
+	b.networks[key] = copyNetwork(obj)
+	b.networks[key].Key = key
+	return nil
+}
+
+func (b *MemBackend) NetworkGet(tenantName, networkName string) (*contivClient.Network, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	obj, ok := b.networks[memKey(tenantName, networkName)]
+	if !ok {
+		return nil, fmt.Errorf("network '%s/%s' not found", networkName, tenantName)
+	}
+	return copyNetwork(obj), nil
+}
+
+func (b *MemBackend) NetworkList() (*[]*contivClient.Network, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	keys := []string{}
+	for key := range b.networks {
+		keys = append(keys, key)
+	}
+	list := []*contivClient.Network{}
+	for _, key := range sortedKeys(keys) {
+		list = append(list, copyNetwork(b.networks[key]))
+	}
+	return &list, nil
+}
+
+func (b *MemBackend) NetworkDelete(tenantName, networkName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := memKey(tenantName, networkName)
+	if _, ok := b.networks[key]; !ok {
+		return fmt.Errorf("network '%s/%s' not found", networkName, tenantName)
+	}
+	delete(b.networks, key)
+	return nil
+}
+
+func (b *MemBackend) EndpointGroupPost(obj *contivClient.EndpointGroup) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, policyName := range obj.Policies {
+		if _, ok := b.policies[memKey(obj.TenantName, policyName)]; !ok {
+			return fmt.Errorf("policy '%s' used by epg '%s' not found", policyName, obj.GroupName)
+		}
+	}
+
+	key := memKey(obj.TenantName, obj.NetworkName, obj.GroupName)
+	b.endpointGroups[key] = copyEpg(obj)
+	b.endpointGroups[key].Key = key
+	return nil
+}
+
+func (b *MemBackend) EndpointGroupGet(tenantName, networkName, groupName string) (*contivClient.EndpointGroup, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	obj, ok := b.endpointGroups[memKey(tenantName, networkName, groupName)]
+	if !ok {
+		return nil, fmt.Errorf("epg '%s' not found", groupName)
+	}
+	return copyEpg(obj), nil
+}
+
+func (b *MemBackend) EndpointGroupList() (*[]*contivClient.EndpointGroup, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	keys := []string{}
+	for key := range b.endpointGroups {
+		keys = append(keys, key)
+	}
+	list := []*contivClient.EndpointGroup{}
+	for _, key := range sortedKeys(keys) {
+		list = append(list, copyEpg(b.endpointGroups[key]))
+	}
+	return &list, nil
+}
+
+func (b *MemBackend) EndpointGroupDelete(tenantName, networkName, groupName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := memKey(tenantName, networkName, groupName)
+	if _, ok := b.endpointGroups[key]; !ok {
+		return fmt.Errorf("epg '%s' not found", groupName)
+	}
+	for _, app := range b.appProfiles {
+		if app.TenantName != tenantName || app.NetworkName != networkName {
+			continue
+		}
+		for _, epgName := range app.EndpointGroups {
+			if epgName == groupName {
+				return fmt.Errorf("epg '%s' is in use by app '%s'", groupName, app.AppProfileName)
+			}
+		}
+	}
+	delete(b.endpointGroups, key)
+	return nil
+}
+
+func (b *MemBackend) PolicyPost(obj *contivClient.Policy) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := memKey(obj.TenantName, obj.PolicyName)
+	b.policies[key] = copyPolicy(obj)
+	b.policies[key].Key = key
+	return nil
+}
+
+func (b *MemBackend) PolicyGet(tenantName, policyName string) (*contivClient.Policy, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	obj, ok := b.policies[memKey(tenantName, policyName)]
+	if !ok {
+		return nil, fmt.Errorf("policy '%s' not found", policyName)
+	}
+	return copyPolicy(obj), nil
+}
+
+func (b *MemBackend) PolicyList() (*[]*contivClient.Policy, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	keys := []string{}
+	for key := range b.policies {
+		keys = append(keys, key)
+	}
+	list := []*contivClient.Policy{}
+	for _, key := range sortedKeys(keys) {
+		list = append(list, copyPolicy(b.policies[key]))
+	}
+	return &list, nil
+}
+
+// PolicyDelete removes the policy along with its rules, like netmaster does
+func (b *MemBackend) PolicyDelete(tenantName, policyName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := memKey(tenantName, policyName)
+	if _, ok := b.policies[key]; !ok {
+		return fmt.Errorf("policy '%s' not found", policyName)
+	}
+	for _, epg := range b.endpointGroups {
+		if epg.TenantName != tenantName {
+			continue
+		}
+		for _, name := range epg.Policies {
+			if name == policyName {
+				return fmt.Errorf("policy '%s' is in use by epg '%s'", policyName, epg.GroupName)
+			}
+		}
+	}
+	for ruleKey, rule := range b.rules {
+		if rule.TenantName == tenantName && rule.PolicyName == policyName {
+			delete(b.rules, ruleKey)
+		}
+	}
+	delete(b.policies, key)
+	return nil
+}
+
+func (b *MemBackend) RulePost(obj *contivClient.Rule) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.policies[memKey(obj.TenantName, obj.PolicyName)]; !ok {
+		return fmt.Errorf("policy '%s' for rule '%s' not found", obj.PolicyName, obj.RuleID)
+	}
+
+	key := memKey(obj.TenantName, obj.PolicyName, obj.RuleID)
+	b.rules[key] = copyRule(obj)
+	b.rules[key].Key = key
+	return nil
+}
+
+func (b *MemBackend) RuleGet(tenantName, policyName, ruleID string) (*contivClient.Rule, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	obj, ok := b.rules[memKey(tenantName, policyName, ruleID)]
+	if !ok {
+		return nil, fmt.Errorf("rule '%s' in policy '%s' not found", ruleID, policyName)
+	}
+	return copyRule(obj), nil
+}
+
+func (b *MemBackend) RuleList() (*[]*contivClient.Rule, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	keys := []string{}
+	for key := range b.rules {
+		keys = append(keys, key)
+	}
+	list := []*contivClient.Rule{}
+	for _, key := range sortedKeys(keys) {
+		list = append(list, copyRule(b.rules[key]))
+	}
+	return &list, nil
+}
+
+func (b *MemBackend) RuleDelete(tenantName, policyName, ruleID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := memKey(tenantName, policyName, ruleID)
+	if _, ok := b.rules[key]; !ok {
+		return fmt.Errorf("rule '%s' in policy '%s' not found", ruleID, policyName)
+	}
+	delete(b.rules, key)
+	return nil
+}
+
+func (b *MemBackend) AppProfilePost(obj *contivClient.AppProfile) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, epgName := range obj.EndpointGroups {
+		if _, ok := b.endpointGroups[memKey(obj.TenantName, obj.NetworkName, epgName)]; !ok {
+			return fmt.Errorf("epg '%s' used by app '%s' not found", epgName, obj.AppProfileName)
+		}
+	}
+
+	key := memKey(obj.TenantName, obj.NetworkName, obj.AppProfileName)
+	b.appProfiles[key] = copyApp(obj)
+	b.appProfiles[key].Key = key
+	return nil
+}
+
+func (b *MemBackend) AppProfileGet(tenantName, networkName, appProfileName string) (*contivClient.AppProfile, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	obj, ok := b.appProfiles[memKey(tenantName, networkName, appProfileName)]
+	if !ok {
+		return nil, fmt.Errorf("app '%s' not found", appProfileName)
+	}
+	return copyApp(obj), nil
+}
+
+func (b *MemBackend) AppProfileList() (*[]*contivClient.AppProfile, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	keys := []string{}
+	for key := range b.appProfiles {
+		keys = append(keys, key)
+	}
+	list := []*contivClient.AppProfile{}
+	for _, key := range sortedKeys(keys) {
+		list = append(list, copyApp(b.appProfiles[key]))
+	}
+	return &list, nil
+}
+
+func (b *MemBackend) AppProfileDelete(tenantName, networkName, appProfileName string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := memKey(tenantName, networkName, appProfileName)
+	if _, ok := b.appProfiles[key]; !ok {
+		return fmt.Errorf("app '%s' not found", appProfileName)
+	}
+	delete(b.appProfiles, key)
+	return nil
+}
@@ -1,9 +1,10 @@
 package nethooks
 
 import (
-	"errors"
-	"os"
+	"fmt"
 	log "github.com/Sirupsen/logrus"
+	"github.com/docker/libcompose/deploy/identity"
+	"github.com/docker/libcompose/config"
 	"github.com/docker/libcompose/deploy/ops"
 	"github.com/docker/libcompose/project"
 	"github.com/docker/libcompose/yaml"
@@ -17,24 +18,40 @@ const (
 	applyContractPolicyFlag    = true
 )
 
-// CreateNetConfig creates network and policies in coniv-netmaster
-func CreateNetConfig(p *project.Project) error {
+// CreateNetConfig creates network and policies in coniv-netmaster; objects
+// left over from an earlier run of the project are updated or removed
+func CreateNetConfig(p *project.Project, principal identity.Principal) error {
 	log.Debugf("Create network for the project '%s' ", p.Name)
 
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	if backend == nil {
+		return fmt.Errorf("%w: not initialized", ErrBackendUnavailable)
+	}
+
+	// the labels are kept so that the containers carry the tenant and network
+	setDefaultTenant(p, principal)
+	setDefaultNetwork(p, principal)
+
 	if err := validateProject(p); err != nil {
-		os.Exit(1)
 		return err
 	}
 
-	if err := checkUserCreds(p); err != nil {
-		os.Exit(1)
+	if err := checkUserCreds(p, principal); err != nil {
 		return err
 	}
 
-	if applyLinksBasedPolicyFlag {
-		if err := applyLinksBasedPolicy(p); err != nil {
-			return err
+	// journal every change so that a failure leaves the tenant as it was
+	tx := newTxBackend(backend)
+	if err := withBackend(tx, func() error { return reconcileNetConfig(p, principal) }); err != nil {
+		log.Errorf("Failed to create network for project '%s', rolling back: %s", p.Name, err)
+		if rbErr := tx.rollback(); rbErr != nil {
+			log.Errorf("Rollback for project '%s' incomplete: %s", p.Name, rbErr)
 		}
+		return err
+	}
+
+	if applyLinksBasedPolicyFlag {
 		if err := clearSvcLinks(p); err != nil {
 			return err
 		}
@@ -47,22 +64,31 @@ func CreateNetConfig(p *project.Project) error {
 }
 
 // DeleteNetConfig removes network and policies in coniv-netmaster 
-func DeleteNetConfig(p *project.Project) error {
+func DeleteNetConfig(p *project.Project, principal identity.Principal) error {
 	log.Debugf("Delete network for the project '%s' ", p.Name)
 
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	if backend == nil {
+		return fmt.Errorf("%w: not initialized", ErrBackendUnavailable)
+	}
+
+	setDefaultTenant(p, principal)
+	setDefaultNetwork(p, principal)
+
 	if err := validateProject(p); err != nil {
-		os.Exit(1)
 		return err
 	}
 
-	if err := checkUserCreds(p); err != nil {
-		os.Exit(1)
+	if err := checkUserCreds(p, principal); err != nil {
 		return err
 	}
 
 	tenantName := getTenantNameFromProject(p)
-	if err := deleteApp(tenantName, p); err != nil {
-		log.Debugf("Unable to delete app. Error %v", err)
+	for _, networkName := range getNetworkNamesFromProject(p) {
+		if err := deleteApp(tenantName, networkName, p); err != nil {
+			log.Debugf("Unable to delete app on network '%s'. Error %v", networkName, err)
+		}
 	}
 
 	for _, svcName := range p.Configs.Keys() {
@@ -87,9 +113,12 @@ func DeleteNetConfig(p *project.Project) error {
 }
 
 // Update service config for scale verb
-func ScaleNetConfig(p *project.Project) error {
+func ScaleNetConfig(p *project.Project, principal identity.Principal) error {
 	log.Debugf("Scale network for the project '%s' ", p.Name)
 
+	setDefaultTenant(p, principal)
+	setDefaultNetwork(p, principal)
+
 	if applyLinksBasedPolicyFlag {
 		if err := clearSvcLinks(p); err != nil {
 			log.Errorf("Unable to clear service links. Error: %s", err)
@@ -107,10 +136,10 @@ func ScaleNetConfig(p *project.Project) error {
 
 // Generate Parameters: new information that was not set by users
 func AutoGenParams(p *project.Project) error {
-	networkName := getNetworkNameFromProject(p)
 	tenantName := getTenantNameFromProject(p)
 	for _, svcName := range p.Configs.Keys() {
 		svc, _ := p.Configs.Get(svcName)
+		networkName := getNetworkName(svc)
 		if svc.DNS.Len() == 0 {
 			dnsAddr, err := getDnsInfo(networkName, tenantName)
 			if err != nil {
@@ -133,7 +162,7 @@ func AutoGenParams(p *project.Project) error {
 }
 
 // Generate labels to tag the services 
-func AutoGenLabels(p *project.Project) error {
+func AutoGenLabels(p *project.Project, principal identity.Principal) error {
 	for _, svcName := range p.Configs.Keys() {
 		svc, _ := p.Configs.Get(svcName)
 		labels := svc.Labels.MapParts()
@@ -142,12 +171,7 @@ func AutoGenLabels(p *project.Project) error {
 		}
 		labels[NET_ISOLATION_GROUP_LABEL] = svcName
 
-		userId, err := getSelfId()
-		if err != nil {
-			log.Errorf("error getting user id: %s", err)
-			return err
-		}
-		labels[USER_LABEL] = userId
+		labels[USER_LABEL] = principal.Name
 
 		svc.Labels = yaml.NewSliceorMap(labels)
 	}
@@ -155,8 +179,8 @@ func AutoGenLabels(p *project.Project) error {
 	return nil
 }
 
-// apply policies based on links (can be 'depends_on' in latest docker)
-func applyLinksBasedPolicy(p *project.Project) error {
+// apply policies based on links, depends_on and shared networks
+func applyLinksBasedPolicy(p *project.Project, principal identity.Principal) error {
 	links, err := getSvcLinks(p)
 	if err != nil {
 		log.Debugf("Unable to find links from service chains. Error %v", err)
@@ -172,7 +196,7 @@ func applyLinksBasedPolicy(p *project.Project) error {
 	for fromSvcName, toSvcNames := range links {
 		for _, toSvcName := range toSvcNames {
 			log.Infof("Creating policy contract from '%s' -> '%s'", fromSvcName, toSvcName)
-			if err := applyInPolicy(p, fromSvcName, toSvcName, policyRecs); err != nil {
+			if err := applyInPolicy(p, principal, fromSvcName, toSvcName, policyRecs); err != nil {
 				log.Errorf("Failed to apply in-policy for service '%s': %s", toSvcName, err)
 				return err
 			}
@@ -184,17 +208,24 @@ func applyLinksBasedPolicy(p *project.Project) error {
 		log.Debugf("Unable to find exposed ports from service chains. Error %v", err)
 		return err
 	}
-	if err := applyExposePolicy(p, spMap, policyRecs); err != nil {
+	if err := applyExposePolicy(p, principal, spMap, policyRecs); err != nil {
 		log.Errorf("Unable to apply expose-policy %v", err)
 		return err
 	}
 
-	tenantName := getTenantNameFromProject(p)
-	if err := addApp(tenantName, p); err != nil {
-		log.Errorf("Unable to create app with unspecified tiers. Error %v", err)
+	if err := applyOutPolicy(p, principal); err != nil {
+		log.Errorf("Unable to apply out-policy %v", err)
 		return err
 	}
 
+	tenantName := getTenantNameFromProject(p)
+	for _, networkName := range getNetworkNamesFromProject(p) {
+		if err := addApp(tenantName, networkName, p); err != nil {
+			log.Errorf("Unable to create app with unspecified tiers. Error %v", err)
+			return err
+		}
+	}
+
 	if applyDefaultPolicyFlag {
 		if err := applyDefaultPolicy(p, policyRecs); err != nil {
 			log.Errorf("Unable to apply policies for unspecified tiers. Error %v", err)
@@ -205,35 +236,101 @@ func applyLinksBasedPolicy(p *project.Project) error {
 	return nil
 }
 
-// Checks User credentials to perform a given operation (move to Authz)
-func checkUserCreds(p *project.Project) error {
-	userId, err := getSelfId()
+// setDefaultTenant labels the services that do not name a tenant with the
+// default tenant of the user, if any; the returned func removes the labels
+func setDefaultTenant(p *project.Project, principal identity.Principal) func() {
+	tenantName, err := ops.UserOpsGetDefaultTenant(principal.Name, principal.Groups...)
 	if err != nil {
-		log.Errorf("Unable to identify self: %s", err)
-		return err
+		return func() {}
 	}
 
-	networkName := getNetworkNameFromProject(p)
-	if err := ops.UserOpsCheckNetwork(userId, networkName); err != nil {
-		log.Errorf("User '%s' not allowed on network '%s'", userId, networkName)
-		return err
+	tenantLabel := getTenantLabel()
+	labeled := []*config.ServiceConfig{}
+	for _, svcName := range p.Configs.Keys() {
+		svc, _ := p.Configs.Get(svcName)
+		labels := svc.Labels.MapParts()
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		if _, ok := labels[tenantLabel]; ok {
+			continue
+		}
+		log.Debugf("Using default tenant '%s' for service '%s'", tenantName, svcName)
+		labels[tenantLabel] = tenantName
+		svc.Labels = yaml.NewSliceorMap(labels)
+		labeled = append(labeled, svc)
 	}
 
-	return nil
+	return func() {
+		for _, svc := range labeled {
+			labels := svc.Labels.MapParts()
+			delete(labels, tenantLabel)
+			svc.Labels = yaml.NewSliceorMap(labels)
+		}
+	}
 }
 
-func validateProject(p *project.Project) error {
-	netName := getNetworkNameFromProject(p)
+// setDefaultNetwork labels the services that do not name a network with the
+// default network of the user, else the one of ops.json, else the builtin
+// one. It returns where the network of each service came from, and a func
+// removing the labels.
+func setDefaultNetwork(p *project.Project, principal identity.Principal) (map[string]string, func()) {
+	networkName, source := NETWORK_DEFAULT, NETWORK_SOURCE_BUILTIN
+	if userNetwork, err := ops.UserOpsGetDefaultNetwork(principal.Name, principal.Groups...); err == nil {
+		networkName, source = userNetwork, NETWORK_SOURCE_USER
+	} else if opsNetwork := ops.DefaultOpsGetNetwork(); opsNetwork != "" {
+		networkName, source = opsNetwork, NETWORK_SOURCE_OPS
+	}
 
+	sources := make(map[string]string)
+	labeled := []*config.ServiceConfig{}
 	for _, svcName := range p.Configs.Keys() {
 		svc, _ := p.Configs.Get(svcName)
-		if getNetworkName(svc) != netName {
-			log.Errorf("Mismatching networks '%s' vs '%s' for services not allowed",
-				netName, getNetworkName(svc))
-			return errors.New("mismatching networks")
+		labels := svc.Labels.MapParts()
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		if _, ok := labels[NETWORK_LABEL]; ok || svc.Net != "" {
+			sources[svcName] = NETWORK_SOURCE_SERVICE
+			continue
+		}
+		log.Infof("Using %s network '%s' for service '%s'", source, networkName, svcName)
+		labels[NETWORK_LABEL] = networkName
+		svc.Labels = yaml.NewSliceorMap(labels)
+		labeled = append(labeled, svc)
+		sources[svcName] = source
+	}
+
+	return sources, func() {
+		for _, svc := range labeled {
+			labels := svc.Labels.MapParts()
+			delete(labels, NETWORK_LABEL)
+			svc.Labels = yaml.NewSliceorMap(labels)
 		}
 	}
+}
+
+// Checks User credentials to perform a given operation (move to Authz)
+func checkUserCreds(p *project.Project, principal identity.Principal) error {
+	tenantName := getTenantNameFromProject(p)
+	if err := ops.UserOpsCheckTenant(principal.Name, tenantName, principal.Groups...); err != nil {
+		log.Errorf("User '%s' not allowed on tenant '%s'", principal.Name, tenantName)
+		return err
+	}
 
+	for _, networkName := range getNetworkNamesFromProject(p) {
+		if err := ops.UserOpsCheckNetwork(principal.Name, networkName, principal.Groups...); err != nil {
+			log.Errorf("User '%s' not allowed on network '%s'", principal.Name, networkName)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateProject checks that all services live in the same tenant; they
+// may be spread over several networks of it
+func validateProject(p *project.Project) error {
 	tenantName := getTenantNameFromProject(p)
 
 	for _, svcName := range p.Configs.Keys() {
@@ -241,7 +338,7 @@ func validateProject(p *project.Project) error {
 		if getTenantName(svc) != tenantName {
 			log.Errorf("Mismatching Tenants '%s' vs '%s' for services not allowed",
 				tenantName, getTenantName(svc))
-			return errors.New("mismatching tenants")
+			return fmt.Errorf("%w: '%s' vs '%s'", ErrMismatchedTenant, tenantName, getTenantName(svc))
 		}
 	}
 
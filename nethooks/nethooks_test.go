@@ -1,6 +1,7 @@
 package nethooks
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -55,7 +56,7 @@ func TestAutoGenLabel(t *testing.T) {
 		labelCount[svcName] = len(svc.Labels.MapParts())
 	}
 
-	if err := AutoGenLabels(p); err != nil {
+	if err := AutoGenLabels(p, testPrincipal); err != nil {
 		t.Fatalf("Unable to auto insert labels to a project. Error %v\n", err)
 	}
 
@@ -64,6 +65,9 @@ func TestAutoGenLabel(t *testing.T) {
 		if labelCount[svcName] == len(svc.Labels.MapParts()) {
 			t.Fatalf("service '%s' did not insert any labels", svcName)
 		}
+		if user := svc.Labels.MapParts()[USER_LABEL]; user != testPrincipal.Name {
+			t.Fatalf("service '%s' labeled with user '%s', expected '%s'", svcName, user, testPrincipal.Name)
+		}
 	}
 
 }
@@ -177,8 +181,11 @@ func TestConflictingNet(t *testing.T) {
 		t.Fatalf("Unable to create a project. Error %v\n", err)
 	}
 
-	if validateProject(p) == nil {
-		t.Fatalf("Successful parsing of mismatching networks")
+	if err := validateProject(p); err != nil {
+		t.Fatalf("Unable to validate services on several networks: %v", err)
+	}
+	if nets := getNetworkNamesFromProject(p); !sameStrings(nets, []string{"dev", "test"}) {
+		t.Fatalf("Unexpected networks %v", nets)
 	}
 }
 
@@ -210,7 +217,7 @@ func TestConflictingTenant(t *testing.T) {
 		t.Fatalf("Unable to create a project. Error %v\n", err)
 	}
 
-	if validateProject(p) == nil {
-		t.Fatalf("Successful parsing of mismatching tenants")
+	if err := validateProject(p); !errors.Is(err, ErrMismatchedTenant) {
+		t.Fatalf("Successful parsing of mismatching tenants: %v", err)
 	}
 }
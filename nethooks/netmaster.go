@@ -0,0 +1,228 @@
+package nethooks
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	contivClient "github.com/contiv/contivmodel/client"
+	"github.com/docker/libcompose/deploy/ops"
+)
+
+const (
+	netmasterDefaultTimeout = 10 * time.Second
+
+	NETMASTER_URL_ENV         = "CONTIV_NETMASTER_URL"
+	NETMASTER_CA_CERT_ENV     = "CONTIV_NETMASTER_CA_CERT"
+	NETMASTER_CLIENT_CERT_ENV = "CONTIV_NETMASTER_CLIENT_CERT"
+	NETMASTER_CLIENT_KEY_ENV  = "CONTIV_NETMASTER_CLIENT_KEY"
+	NETMASTER_TOKEN_ENV       = "CONTIV_NETMASTER_TOKEN"
+	NETMASTER_TIMEOUT_ENV     = "CONTIV_NETMASTER_TIMEOUT"
+)
+
+// NetmasterConfig describes how to reach netmaster. Empty fields are
+// filled from the environment, then from ops.json, then from defaults.
+type NetmasterConfig struct {
+	URL        string
+	CACert     string
+	ClientCert string
+	ClientKey  string
+	Token      string
+	Timeout    time.Duration
+}
+
+func mergeNetmasterConfig(cfg *NetmasterConfig, url, caCert, clientCert, clientKey, token, timeout string) error {
+	if cfg.URL == "" {
+		cfg.URL = url
+	}
+	if cfg.CACert == "" {
+		cfg.CACert = caCert
+	}
+	if cfg.ClientCert == "" {
+		cfg.ClientCert = clientCert
+	}
+	if cfg.ClientKey == "" {
+		cfg.ClientKey = clientKey
+	}
+	if cfg.Token == "" {
+		cfg.Token = token
+	}
+	if cfg.Timeout == 0 && timeout != "" {
+		t, err := time.ParseDuration(timeout)
+		if err != nil {
+			return fmt.Errorf("invalid netmaster timeout '%s': %s", timeout, err)
+		}
+		cfg.Timeout = t
+	}
+	return nil
+}
+
+// GetNetmasterConfig completes the passed settings from the environment,
+// ops.json and the defaults, in that order of precedence
+func GetNetmasterConfig(cfg NetmasterConfig) (NetmasterConfig, error) {
+	if err := mergeNetmasterConfig(&cfg,
+		os.Getenv(NETMASTER_URL_ENV),
+		os.Getenv(NETMASTER_CA_CERT_ENV),
+		os.Getenv(NETMASTER_CLIENT_CERT_ENV),
+		os.Getenv(NETMASTER_CLIENT_KEY_ENV),
+		os.Getenv(NETMASTER_TOKEN_ENV),
+		os.Getenv(NETMASTER_TIMEOUT_ENV)); err != nil {
+		return cfg, err
+	}
+
+	opsCfg := ops.NetmasterOpsGet()
+	if err := mergeNetmasterConfig(&cfg, opsCfg.URL, opsCfg.CACert, opsCfg.ClientCert,
+		opsCfg.ClientKey, opsCfg.Token, opsCfg.Timeout); err != nil {
+		return cfg, err
+	}
+
+	if cfg.URL == "" {
+		cfg.URL = netmasterBaseURL
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = netmasterDefaultTimeout
+	}
+
+	return cfg, nil
+}
+
+// Validate checks that the settings are consistent before dialing
+func (cfg NetmasterConfig) Validate() error {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return fmt.Errorf("invalid netmaster url '%s': %s", cfg.URL, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid netmaster url '%s': scheme must be http or https", cfg.URL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid netmaster url '%s': host missing", cfg.URL)
+	}
+
+	if (cfg.ClientCert == "") != (cfg.ClientKey == "") {
+		return errors.New("netmaster client certificate and key must be specified together")
+	}
+	if u.Scheme != "https" && (cfg.CACert != "" || cfg.ClientCert != "") {
+		return fmt.Errorf("netmaster url '%s' must be https to use certificates", cfg.URL)
+	}
+	if cfg.Timeout < 0 {
+		return fmt.Errorf("invalid netmaster timeout %s", cfg.Timeout)
+	}
+
+	return nil
+}
+
+func (cfg NetmasterConfig) tlsConfig() (*tls.Config, error) {
+	tlsCfg := &tls.Config{}
+
+	if cfg.CACert != "" {
+		caData, err := ioutil.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read netmaster CA bundle: %s", err)
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(caData) {
+			return nil, fmt.Errorf("no certificates found in netmaster CA bundle '%s'", cfg.CACert)
+		}
+	}
+
+	if cfg.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load netmaster client certificate: %s", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsCfg, nil
+}
+
+func (cfg NetmasterConfig) httpClient() (*http.Client, error) {
+	tlsCfg, err := cfg.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Client{
+		Timeout:   cfg.Timeout,
+		Transport: &http.Transport{TLSClientConfig: tlsCfg},
+	}, nil
+}
+
+// checkNetmasterReachable makes sure something listens at the netmaster
+// address, so that a wrong endpoint is reported once and clearly
+func checkNetmasterReachable(cfg NetmasterConfig) error {
+	u, _ := url.Parse(cfg.URL)
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	conn, err := net.DialTimeout("tcp", host, cfg.Timeout)
+	if err != nil {
+		return fmt.Errorf("%w: netmaster at '%s' is unreachable: %s", ErrBackendUnavailable, cfg.URL, err)
+	}
+	conn.Close()
+
+	return nil
+}
+
+// InitWithConfig connects to netmaster using the given settings and makes it
+// the policy backend
+func InitWithConfig(cfg NetmasterConfig) error {
+	cfg, err := GetNetmasterConfig(cfg)
+	if err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	hc, err := cfg.httpClient()
+	if err != nil {
+		return err
+	}
+
+	if err := checkNetmasterReachable(cfg); err != nil {
+		log.Errorf("Error connecting to netmaster: %s", err)
+		return err
+	}
+
+	cl, err := contivClient.NewContivClient(cfg.URL)
+	if err != nil {
+		log.Errorf("Error connecting to netmaster")
+		return err
+	}
+	cl.SetHttpClient(hc)
+
+	if cfg.Token != "" {
+		if u, _ := url.Parse(cfg.URL); u.Scheme != "https" {
+			log.Warnf("Sending netmaster auth token over plain http")
+		}
+		if err := cl.SetAuthToken(cfg.Token); err != nil {
+			log.Errorf("Unable to set netmaster auth token: %s", err)
+			return err
+		}
+	}
+
+	log.Debugf("Using netmaster at '%s'", cfg.URL)
+	SetBackend(cl)
+	return nil
+}
+
+// Init connects to netmaster and makes it the policy backend
+func Init() error {
+	return InitWithConfig(NetmasterConfig{})
+}
@@ -0,0 +1,99 @@
+package nethooks
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNetmasterConfigPrecedence(t *testing.T) {
+	loadTestOps(t, `
+		{ "Netmaster": { "URL": "https://ops-netmaster:9999", "Token": "ops-token", "Timeout": "3s" } }
+	`)
+
+	os.Setenv(NETMASTER_URL_ENV, "https://env-netmaster:9999")
+	defer os.Unsetenv(NETMASTER_URL_ENV)
+
+	cfg, err := GetNetmasterConfig(NetmasterConfig{})
+	if err != nil {
+		t.Fatalf("error getting netmaster config: %s", err)
+	}
+	if cfg.URL != "https://env-netmaster:9999" {
+		t.Fatalf("environment did not override ops.json url: %s", cfg.URL)
+	}
+	if cfg.Token != "ops-token" || cfg.Timeout != 3*time.Second {
+		t.Fatalf("ops.json settings not used: %#v", cfg)
+	}
+
+	cfg, err = GetNetmasterConfig(NetmasterConfig{URL: "https://opt-netmaster:9999"})
+	if err != nil {
+		t.Fatalf("error getting netmaster config: %s", err)
+	}
+	if cfg.URL != "https://opt-netmaster:9999" {
+		t.Fatalf("option did not override environment url: %s", cfg.URL)
+	}
+
+	loadTestOps(t, `{}`)
+	os.Unsetenv(NETMASTER_URL_ENV)
+	cfg, err = GetNetmasterConfig(NetmasterConfig{})
+	if err != nil {
+		t.Fatalf("error getting netmaster config: %s", err)
+	}
+	if cfg.URL != netmasterBaseURL || cfg.Timeout != netmasterDefaultTimeout {
+		t.Fatalf("defaults not applied: %#v", cfg)
+	}
+
+	loadTestOps(t, `{ "Netmaster": { "Timeout": "soon" } }`)
+	if _, err := GetNetmasterConfig(NetmasterConfig{}); err == nil {
+		t.Fatalf("accepted an invalid timeout")
+	}
+}
+
+func TestNetmasterConfigValidate(t *testing.T) {
+	valid := []NetmasterConfig{
+		{URL: "http://netmaster:9999"},
+		{URL: "https://netmaster:9999", CACert: "/ca.pem", ClientCert: "/c.pem", ClientKey: "/k.pem"},
+	}
+	for _, cfg := range valid {
+		if err := cfg.Validate(); err != nil {
+			t.Fatalf("valid config %#v rejected: %s", cfg, err)
+		}
+	}
+
+	invalid := []NetmasterConfig{
+		{URL: "netmaster:9999"},
+		{URL: "ftp://netmaster:9999"},
+		{URL: "https://"},
+		{URL: "https://netmaster:9999", ClientCert: "/c.pem"},
+		{URL: "http://netmaster:9999", CACert: "/ca.pem"},
+		{URL: "http://netmaster:9999", Timeout: -time.Second},
+	}
+	for _, cfg := range invalid {
+		if err := cfg.Validate(); err == nil {
+			t.Fatalf("invalid config %#v accepted", cfg)
+		}
+	}
+}
+
+func TestNetmasterUnreachable(t *testing.T) {
+	loadTestOps(t, `{}`)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	err = InitWithConfig(NetmasterConfig{URL: "http://" + addr, Timeout: time.Second})
+	if err == nil || !strings.Contains(err.Error(), "unreachable") {
+		t.Fatalf("unexpected error for unreachable netmaster: %v", err)
+	}
+
+	err = InitWithConfig(NetmasterConfig{URL: "https://" + addr, CACert: "/nonexistent/ca.pem"})
+	if err == nil {
+		t.Fatalf("missing CA bundle accepted")
+	}
+}
@@ -0,0 +1,342 @@
+package nethooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	contivClient "github.com/contiv/contivmodel/client"
+	"github.com/docker/libcompose/deploy/identity"
+	"github.com/docker/libcompose/project"
+)
+
+// PlanOp is a single change a composition would make in netmaster: the
+// create, update or delete of an object
+type PlanOp struct {
+	Action string      `json:"action"`
+	Kind   string      `json:"kind"`
+	Key    string      `json:"key"`
+	Object interface{} `json:"object"`
+}
+
+// PlanNetwork is the network a service is placed on, and where it came from
+type PlanNetwork struct {
+	Service string `json:"service"`
+	Network string `json:"network"`
+	Source  string `json:"source"`
+}
+
+// Plan lists, in order, the changes CreateNetConfig would make in netmaster
+type Plan struct {
+	Project  string        `json:"project"`
+	Tenant   string        `json:"tenant"`
+	Networks []PlanNetwork `json:"networks"`
+	Ops      []PlanOp      `json:"ops"`
+}
+
+// recordingBackend keeps the posted objects in memory and records every
+// post and delete, so the translation can run without touching netmaster
+type recordingBackend struct {
+	*MemBackend
+	ops []PlanOp
+}
+
+func newRecordingBackend() *recordingBackend {
+	return &recordingBackend{MemBackend: NewMemBackend()}
+}
+
+func (b *recordingBackend) record(exists bool, kind, key string, obj interface{}) {
+	action := "create"
+	if exists {
+		action = "update"
+	}
+	// objects replaced by a delete and a post, such as rules, are updates
+	if n := len(b.ops); !exists && n > 0 {
+		if last := b.ops[n-1]; last.Action == "delete" && last.Kind == kind && last.Key == key {
+			b.ops[n-1] = PlanOp{Action: "update", Kind: kind, Key: key, Object: obj}
+			return
+		}
+	}
+	b.ops = append(b.ops, PlanOp{Action: action, Kind: kind, Key: key, Object: obj})
+}
+
+// load fills the backend with the objects of state, without recording them
+func (b *recordingBackend) load(state *netState) error {
+	for _, key := range sortedStateKeys(state.policies) {
+		if err := b.MemBackend.PolicyPost(state.policies[key]); err != nil {
+			return err
+		}
+	}
+	for _, key := range sortedStateKeys(state.rules) {
+		if err := b.MemBackend.RulePost(state.rules[key]); err != nil {
+			return err
+		}
+	}
+	for _, key := range sortedStateKeys(state.endpointGroups) {
+		if err := b.MemBackend.EndpointGroupPost(state.endpointGroups[key]); err != nil {
+			return err
+		}
+	}
+	for _, key := range sortedStateKeys(state.appProfiles) {
+		if err := b.MemBackend.AppProfilePost(state.appProfiles[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *recordingBackend) TenantPost(obj *contivClient.Tenant) error {
+	_, err := b.MemBackend.TenantGet(obj.TenantName)
+	exists := err == nil
+	if err := b.MemBackend.TenantPost(obj); err != nil {
+		return err
+	}
+	b.record(exists, "tenant", memKey(obj.TenantName), copyTenant(obj))
+	return nil
+}
+
+func (b *recordingBackend) NetworkPost(obj *contivClient.Network) error {
+	_, err := b.MemBackend.NetworkGet(obj.TenantName, obj.NetworkName)
+	exists := err == nil
+	if err := b.MemBackend.NetworkPost(obj); err != nil {
+		return err
+	}
+	b.record(exists, "network", memKey(obj.TenantName, obj.NetworkName), copyNetwork(obj))
+	return nil
+}
+
+func (b *recordingBackend) EndpointGroupPost(obj *contivClient.EndpointGroup) error {
+	_, err := b.MemBackend.EndpointGroupGet(obj.TenantName, obj.NetworkName, obj.GroupName)
+	exists := err == nil
+	if err := b.MemBackend.EndpointGroupPost(obj); err != nil {
+		return err
+	}
+	b.record(exists, "epg", memKey(obj.TenantName, obj.NetworkName, obj.GroupName), copyEpg(obj))
+	return nil
+}
+
+func (b *recordingBackend) PolicyPost(obj *contivClient.Policy) error {
+	_, err := b.MemBackend.PolicyGet(obj.TenantName, obj.PolicyName)
+	exists := err == nil
+	if err := b.MemBackend.PolicyPost(obj); err != nil {
+		return err
+	}
+	b.record(exists, "policy", memKey(obj.TenantName, obj.PolicyName), copyPolicy(obj))
+	return nil
+}
+
+func (b *recordingBackend) RulePost(obj *contivClient.Rule) error {
+	_, err := b.MemBackend.RuleGet(obj.TenantName, obj.PolicyName, obj.RuleID)
+	exists := err == nil
+	if err := b.MemBackend.RulePost(obj); err != nil {
+		return err
+	}
+	b.record(exists, "rule", memKey(obj.TenantName, obj.PolicyName, obj.RuleID), copyRule(obj))
+	return nil
+}
+
+func (b *recordingBackend) AppProfilePost(obj *contivClient.AppProfile) error {
+	_, err := b.MemBackend.AppProfileGet(obj.TenantName, obj.NetworkName, obj.AppProfileName)
+	exists := err == nil
+	if err := b.MemBackend.AppProfilePost(obj); err != nil {
+		return err
+	}
+	b.record(exists, "app", memKey(obj.TenantName, obj.NetworkName, obj.AppProfileName), copyApp(obj))
+	return nil
+}
+
+func (b *recordingBackend) EndpointGroupDelete(tenantName, networkName, groupName string) error {
+	if err := b.MemBackend.EndpointGroupDelete(tenantName, networkName, groupName); err != nil {
+		return err
+	}
+	b.ops = append(b.ops, PlanOp{Action: "delete", Kind: "epg", Key: memKey(tenantName, networkName, groupName)})
+	return nil
+}
+
+func (b *recordingBackend) PolicyDelete(tenantName, policyName string) error {
+	if err := b.MemBackend.PolicyDelete(tenantName, policyName); err != nil {
+		return err
+	}
+	b.ops = append(b.ops, PlanOp{Action: "delete", Kind: "policy", Key: memKey(tenantName, policyName)})
+	return nil
+}
+
+func (b *recordingBackend) RuleDelete(tenantName, policyName, ruleID string) error {
+	if err := b.MemBackend.RuleDelete(tenantName, policyName, ruleID); err != nil {
+		return err
+	}
+	b.ops = append(b.ops, PlanOp{Action: "delete", Kind: "rule", Key: memKey(tenantName, policyName, ruleID)})
+	return nil
+}
+
+func (b *recordingBackend) AppProfileDelete(tenantName, networkName, appProfileName string) error {
+	if err := b.MemBackend.AppProfileDelete(tenantName, networkName, appProfileName); err != nil {
+		return err
+	}
+	b.ops = append(b.ops, PlanOp{Action: "delete", Kind: "app", Key: memKey(tenantName, networkName, appProfileName)})
+	return nil
+}
+
+// withBackend runs fn with b temporarily installed as the policy backend;
+// the caller holds backendMu
+func withBackend(b PolicyBackend, fn func() error) error {
+	saved := backend
+	backend = b
+	defer func() { backend = saved }()
+
+	return fn()
+}
+
+// PlanNetConfig works out the changes CreateNetConfig would make: the
+// objects the project translates to are diffed against those of the
+// project in netmaster, and the creates, updates and deletes of the
+// reconcile are recorded. Netmaster is only read; neither it nor the
+// project are modified.
+func PlanNetConfig(p *project.Project, principal identity.Principal) (*Plan, error) {
+	log.Debugf("Plan network for the project '%s' ", p.Name)
+
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	if backend == nil {
+		return nil, fmt.Errorf("%w: not initialized", ErrBackendUnavailable)
+	}
+
+	defer setDefaultTenant(p, principal)()
+	sources, undo := setDefaultNetwork(p, principal)
+	defer undo()
+
+	if err := validateProject(p); err != nil {
+		return nil, err
+	}
+
+	if err := checkUserCreds(p, principal); err != nil {
+		return nil, err
+	}
+
+	desired, err := getDesiredNetState(p, principal)
+	if err != nil {
+		return nil, err
+	}
+	current, err := readNetState(backend, p, getTenantNameFromProject(p))
+	if err != nil {
+		log.Errorf("Unable to read network state of project '%s'. Error %v", p.Name, err)
+		return nil, fmt.Errorf("%w: %s", ErrBackendUnavailable, err)
+	}
+
+	rec := newRecordingBackend()
+	if err := rec.load(current); err != nil {
+		return nil, err
+	}
+	if _, err := applyNetState(rec, current, desired); err != nil {
+		return nil, err
+	}
+
+	networks := []PlanNetwork{}
+	for _, svcName := range p.Configs.Keys() {
+		svc, _ := p.Configs.Get(svcName)
+		networks = append(networks, PlanNetwork{
+			Service: svcName,
+			Network: getNetworkName(svc),
+			Source:  sources[svcName],
+		})
+	}
+
+	return &Plan{
+		Project:  p.Name,
+		Tenant:   getTenantNameFromProject(p),
+		Networks: networks,
+		Ops:      rec.ops,
+	}, nil
+}
+
+func describeRule(rule *contivClient.Rule) string {
+	proto := rule.Protocol
+	if proto == "" {
+		proto = "any"
+	}
+	if rule.Port != 0 {
+		proto = fmt.Sprintf("%s/%d", proto, rule.Port)
+	}
+
+	peer := "any"
+	switch {
+	case rule.FromEndpointGroup != "":
+		peer = "epg " + rule.FromEndpointGroup
+	case rule.FromIpAddress != "":
+		peer = rule.FromIpAddress
+	case rule.ToEndpointGroup != "":
+		peer = "epg " + rule.ToEndpointGroup
+	case rule.ToIpAddress != "":
+		peer = rule.ToIpAddress
+	}
+	dir := "from"
+	if rule.Direction == "out" {
+		dir = "to"
+	}
+
+	return fmt.Sprintf("%s: %s %s %s %s (priority %d)", rule.RuleID, rule.Action, proto, dir, peer, rule.Priority)
+}
+
+func describeOp(op PlanOp) string {
+	switch obj := op.Object.(type) {
+	case *contivClient.Tenant:
+		return obj.TenantName
+	case *contivClient.Network:
+		return obj.NetworkName
+	case *contivClient.EndpointGroup:
+		return fmt.Sprintf("%s (network %s, policies [%s])", obj.GroupName, obj.NetworkName,
+			strings.Join(obj.Policies, ", "))
+	case *contivClient.Policy:
+		return obj.PolicyName
+	case *contivClient.Rule:
+		return obj.PolicyName + " " + describeRule(obj)
+	case *contivClient.AppProfile:
+		return fmt.Sprintf("%s (network %s, epgs [%s])", obj.AppProfileName, obj.NetworkName,
+			strings.Join(obj.EndpointGroups, ", "))
+	}
+	return op.Key
+}
+
+// WriteText prints the plan in a human readable form
+func (plan *Plan) WriteText(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "Plan for project '%s' in tenant '%s':\n", plan.Project, plan.Tenant); err != nil {
+		return err
+	}
+	for _, network := range plan.Networks {
+		if _, err := fmt.Fprintf(w, "  service %s on network %s (%s)\n",
+			network.Service, network.Network, network.Source); err != nil {
+			return err
+		}
+	}
+	for _, op := range plan.Ops {
+		sign := "+"
+		switch op.Action {
+		case "update":
+			sign = "~"
+		case "delete":
+			sign = "-"
+		}
+		if _, err := fmt.Fprintf(w, "  %s %-7s %s\n", sign, op.Kind, describeOp(op)); err != nil {
+			return err
+		}
+	}
+	counts := map[string]int{}
+	for _, op := range plan.Ops {
+		counts[op.Action]++
+	}
+	_, err := fmt.Fprintf(w, "%d object(s) would be created, %d updated and %d deleted in netmaster\n",
+		counts["create"], counts["update"], counts["delete"])
+	return err
+}
+
+// WriteJSON prints the plan as indented json
+func (plan *Plan) WriteJSON(w io.Writer) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
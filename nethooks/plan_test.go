@@ -0,0 +1,241 @@
+package nethooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPlanNetConfig(t *testing.T) {
+	loadTestOps(t, testOps)
+	p := newTestProject(t, testCompose)
+
+	if _, err := PlanNetConfig(p, testPrincipal); !errors.Is(err, ErrBackendUnavailable) {
+		t.Fatalf("planned without a backend: %v", err)
+	}
+
+	b := NewMemBackend()
+	SetBackend(b)
+	defer SetBackend(nil)
+
+	plan, err := PlanNetConfig(p, testPrincipal)
+	if err != nil {
+		t.Fatalf("Unable to plan net config. Error %v", err)
+	}
+	if backend != b {
+		t.Fatalf("planning left another backend installed")
+	}
+	if rules, _ := b.RuleList(); len(*rules) != 0 {
+		t.Fatalf("planning posted to the backend: %v", *rules)
+	}
+
+	kinds := map[string]int{}
+	for _, op := range plan.Ops {
+		kinds[op.Kind]++
+	}
+	if kinds["policy"] != 2 || kinds["rule"] != 4 || kinds["app"] != 1 || kinds["epg"] == 0 {
+		t.Fatalf("unexpected plan %#v", plan.Ops)
+	}
+
+	svc, _ := p.Configs.Get("web")
+	if len(svc.Links.Slice()) != 1 || len(svc.Ports) != 1 {
+		t.Fatalf("planning modified the project: links %v ports %v", svc.Links.Slice(), svc.Ports)
+	}
+
+	text := &bytes.Buffer{}
+	if err := plan.WriteText(text); err != nil {
+		t.Fatalf("Unable to write plan. Error %v", err)
+	}
+	if !strings.Contains(text.String(), "example_redis-in in-allow-tcp-6379-from-epg-example_web: allow tcp/6379 from epg example_web") {
+		t.Fatalf("unexpected text plan:\n%s", text.String())
+	}
+
+	out := &bytes.Buffer{}
+	if err := plan.WriteJSON(out); err != nil {
+		t.Fatalf("Unable to write plan. Error %v", err)
+	}
+	decoded := Plan{}
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("Unable to decode json plan. Error %v", err)
+	}
+	if decoded.Project != "example" || len(decoded.Ops) != len(plan.Ops) {
+		t.Fatalf("unexpected json plan %s", out.String())
+	}
+}
+
+func TestPlanReconcile(t *testing.T) {
+	loadTestOps(t, testOps)
+
+	b := NewMemBackend()
+	SetBackend(b)
+	defer SetBackend(nil)
+
+	if err := CreateNetConfig(newTestProject(t, `
+            web:
+              image: web
+              links:
+               - redis
+            worker:
+              image: worker
+            redis:
+              image: redis
+              labels:
+                io.contiv.policy: "RedisDefault"
+            `), testPrincipal); err != nil {
+		t.Fatalf("Unable to create net config. Error %v", err)
+	}
+
+	// nothing left to do for the same composition
+	p := newTestProject(t, `
+            web:
+              image: web
+              links:
+               - redis
+            worker:
+              image: worker
+            redis:
+              image: redis
+              labels:
+                io.contiv.policy: "RedisDefault"
+            `)
+	plan, err := PlanNetConfig(p, testPrincipal)
+	if err != nil {
+		t.Fatalf("Unable to plan net config. Error %v", err)
+	}
+	if len(plan.Ops) != 0 {
+		t.Fatalf("changes planned for an unchanged project: %#v", plan.Ops)
+	}
+
+	// a service removed and a policy changed
+	rules, _ := b.RuleList()
+	before := len(*rules)
+	p = newTestProject(t, `
+            web:
+              image: web
+              links:
+               - redis
+            redis:
+              image: redis
+              labels:
+                io.contiv.policy: "AllPriviliges"
+            `)
+	plan, err = PlanNetConfig(p, testPrincipal)
+	if err != nil {
+		t.Fatalf("Unable to plan net config. Error %v", err)
+	}
+	actions := map[string]int{}
+	for _, op := range plan.Ops {
+		actions[op.Action+" "+op.Kind]++
+	}
+	if actions["delete epg"] != 1 || actions["delete policy"] != 1 || actions["update app"] != 1 {
+		t.Fatalf("unexpected plan %v", actions)
+	}
+	if rules, _ := b.RuleList(); len(*rules) != before {
+		t.Fatalf("planning changed the backend")
+	}
+
+	text := &bytes.Buffer{}
+	if err := plan.WriteText(text); err != nil {
+		t.Fatalf("Unable to write plan. Error %v", err)
+	}
+	if !strings.Contains(text.String(), "- epg     default:dev:example_worker") {
+		t.Fatalf("unexpected text plan:\n%s", text.String())
+	}
+}
+
+func TestPlanDefaultNetwork(t *testing.T) {
+	defer SetBackend(nil)
+	compose := `
+            web:
+              image: web
+              links:
+               - redis
+            redis:
+              image: redis
+              net: test
+            `
+	for _, tc := range []struct {
+		ops     string
+		network string
+		source  string
+	}{
+		{`{ "UserPolicy" : [ { "User":"$USER", "Networks": "all", "DefaultNetwork": "prod",
+			"NetworkPolicies": "all", "DefaultNetworkPolicy": "AllPriviliges" } ],
+			"DefaultNetwork": "staging", "NetworkPolicy" : [ { "Name":"AllPriviliges", "Rules": ["permit all"] } ] }`,
+			"prod", NETWORK_SOURCE_USER},
+		{`{ "UserPolicy" : [ { "User":"$USER", "Networks": "all",
+			"NetworkPolicies": "all", "DefaultNetworkPolicy": "AllPriviliges" } ],
+			"DefaultNetwork": "staging", "NetworkPolicy" : [ { "Name":"AllPriviliges", "Rules": ["permit all"] } ] }`,
+			"staging", NETWORK_SOURCE_OPS},
+		{testOps, NETWORK_DEFAULT, NETWORK_SOURCE_BUILTIN},
+	} {
+		loadTestOps(t, tc.ops)
+		p := newTestProject(t, compose)
+		SetBackend(NewMemBackend())
+
+		plan, err := PlanNetConfig(p, testPrincipal)
+		if err != nil {
+			t.Fatalf("Unable to plan net config. Error %v", err)
+		}
+		networks := map[string]PlanNetwork{}
+		for _, network := range plan.Networks {
+			networks[network.Service] = network
+		}
+		if networks["web"].Network != tc.network || networks["web"].Source != tc.source {
+			t.Fatalf("unexpected network of service 'web': %#v", networks["web"])
+		}
+		if networks["redis"].Network != "test" || networks["redis"].Source != NETWORK_SOURCE_SERVICE {
+			t.Fatalf("unexpected network of service 'redis': %#v", networks["redis"])
+		}
+
+		text := &bytes.Buffer{}
+		if err := plan.WriteText(text); err != nil {
+			t.Fatalf("Unable to write plan. Error %v", err)
+		}
+		if !strings.Contains(text.String(), "service web on network "+tc.network+" ("+tc.source+")") {
+			t.Fatalf("network source not in text plan:\n%s", text.String())
+		}
+
+		svc, _ := p.Configs.Get("web")
+		if _, ok := svc.Labels.MapParts()[NETWORK_LABEL]; ok {
+			t.Fatalf("planning left a network label on the project")
+		}
+	}
+}
+
+func TestPlanConcurrent(t *testing.T) {
+	loadTestOps(t, testOps)
+
+	b := NewMemBackend()
+	SetBackend(b)
+	defer SetBackend(nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		plan, up := newTestProject(t, testCompose), newTestProject(t, testCompose)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if _, err := PlanNetConfig(plan, testPrincipal); err != nil {
+				t.Errorf("Unable to plan net config. Error %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if err := CreateNetConfig(up, testPrincipal); err != nil {
+				t.Errorf("Unable to create net config. Error %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if GetBackend() != b {
+		t.Fatalf("concurrent calls left another backend installed")
+	}
+	if rules, _ := b.RuleList(); len(*rules) != 4 {
+		t.Fatalf("unexpected rules after concurrent calls: %v", *rules)
+	}
+}
@@ -1,12 +1,16 @@
 package nethooks
 
 import (
+	"errors"
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
 	contivClient "github.com/contiv/contivmodel/client"
 	"github.com/docker/go-connections/nat"
+	"github.com/docker/libcompose/deploy/identity"
 	"github.com/docker/libcompose/deploy/ops"
 	"github.com/docker/libcompose/config"
 	"github.com/docker/libcompose/project"
@@ -14,24 +18,61 @@ import (
 )
 
 type policyCreateRec struct {
-	nextRuleId    int
 	policyApplied bool
 }
 
-var cl *contivClient.ContivClient
+// getPolicyRulePriority returns the priority of the index-th clause of an
+// ops.json policy, the first clause getting the highest one
+func getPolicyRulePriority(index int) (int, error) {
+	return getBandRulePriority(index, RULE_PRIORITY_POLICY_MIN, RULE_PRIORITY_POLICY_MAX)
+}
 
-func Init() error {
-	var err error
-	cl, err = contivClient.NewContivClient(netmasterBaseURL)
-	if err != nil {
-		log.Errorf("Error connecting to netmaster")
-	}
+// getOverrideRulePriority returns the priority of the index-th clause of
+// rules given in the labels of a service
+func getOverrideRulePriority(index int) (int, error) {
+	return getBandRulePriority(index, RULE_PRIORITY_OVERRIDE_MIN, RULE_PRIORITY_OVERRIDE_MAX)
+}
 
-	return err
+func getBandRulePriority(index, min, max int) (int, error) {
+	priority := max - index
+	if priority < min {
+		return 0, fmt.Errorf("policy has more than %d rules", max-min+1)
+	}
+	return priority, nil
 }
 
-func getRuleStr(ruleID int) string {
-	return string(ruleID + '0')
+// getRuleID derives the ID of a rule from what it matches, so that a rule
+// keeps its ID from one run to the next and different rules of a policy
+// never share one
+func getRuleID(rule *contivClient.Rule) string {
+	proto := rule.Protocol
+	if proto == "" {
+		proto = "all"
+	}
+	parts := []string{rule.Direction, rule.Action, proto}
+	if rule.Port != 0 {
+		parts = append(parts, strconv.Itoa(rule.Port))
+	}
+
+	switch {
+	case rule.FromEndpointGroup != "":
+		parts = append(parts, "from-epg", rule.FromEndpointGroup)
+	case rule.FromIpAddress != "":
+		parts = append(parts, "from-ip", rule.FromIpAddress)
+	case rule.FromNetwork != "":
+		parts = append(parts, "from-net", rule.FromNetwork)
+	}
+	switch {
+	case rule.ToEndpointGroup != "":
+		parts = append(parts, "to-epg", rule.ToEndpointGroup)
+	case rule.ToIpAddress != "":
+		parts = append(parts, "to-ip", rule.ToIpAddress)
+	case rule.ToNetwork != "":
+		parts = append(parts, "to-net", rule.ToNetwork)
+	}
+
+	// netmaster keys objects by ':' separated names
+	return strings.NewReplacer(":", "_", "/", "_").Replace(strings.Join(parts, "-"))
 }
 
 func getInPolicyStr(projectName, svcName string) string {
@@ -50,15 +91,18 @@ func getTenantNameFromProject(p *project.Project) string {
 	return ""
 }
 
+func getTenantLabel() string {
+	if tenantLabel := ops.LabelOpsGetTenant(); tenantLabel != "" {
+		return tenantLabel
+	}
+	return TENANT_LABEL
+}
+
 func getTenantName(svc *config.ServiceConfig) string {
 	tenantName := TENANT_DEFAULT
 
-	tenantLabel := ops.LabelOpsGetTenant()
-	if tenantLabel == "" {
-		tenantLabel = TENANT_LABEL
-	}
 	if labels := svc.Labels.MapParts(); labels != nil {
-		if value, ok := labels[tenantLabel]; ok {
+		if value, ok := labels[getTenantLabel()]; ok {
 			tenantName = value
 		}
 	}
@@ -87,6 +131,22 @@ func getNetworkNameFromProject(p *project.Project) string {
 	return ""
 }
 
+// getNetworkNamesFromProject returns the networks the services are spread over
+func getNetworkNamesFromProject(p *project.Project) []string {
+	seen := make(map[string]bool)
+	networkNames := []string{}
+	for _, svcName := range p.Configs.Keys() {
+		svc, _ := p.Configs.Get(svcName)
+		networkName := getNetworkName(svc)
+		if !seen[networkName] {
+			seen[networkName] = true
+			networkNames = append(networkNames, networkName)
+		}
+	}
+	sort.Strings(networkNames)
+	return networkNames
+}
+
 func getFullSvcName(p *project.Project, svcName string) string {
 	svc, _ := p.Configs.Get(svcName)
 	netName := getNetworkName(svc)
@@ -116,13 +176,104 @@ func getFromEpgName(p *project.Project, fromSvcName string) string {
 	return ""
 }
 
+// getLinkTarget strips the alias off a 'service:alias' link
+func getLinkTarget(link string) string {
+	if idx := strings.Index(link, ":"); idx != -1 {
+		return link[:idx]
+	}
+	return link
+}
+
+// getSvcNetworks returns the user-defined networks a service joins, mapped to
+// the aliases it has on each of them
+func getSvcNetworks(svc *config.ServiceConfig) map[string][]string {
+	networks := make(map[string][]string)
+	if svc.Networks == nil {
+		return networks
+	}
+	for _, network := range svc.Networks.Networks {
+		if network.Name == "" || network.Name == "default" {
+			continue
+		}
+		networks[network.Name] = network.Aliases
+	}
+	return networks
+}
+
+// resolveSvcName maps a link target to a service of the project, either by
+// name or by a network alias the service has on a network shared with fromSvc
+func resolveSvcName(p *project.Project, fromSvc *config.ServiceConfig, target string) (string, bool) {
+	if p.Configs.Has(target) {
+		return target, true
+	}
+
+	fromNets := getSvcNetworks(fromSvc)
+	for _, svcName := range p.Configs.Keys() {
+		svc, _ := p.Configs.Get(svcName)
+		for netName, aliases := range getSvcNetworks(svc) {
+			if _, ok := fromNets[netName]; !ok {
+				continue
+			}
+			for _, alias := range aliases {
+				if alias == target {
+					return svcName, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// getSvcLinks returns, for each service, the services it consumes. Links
+// and depends_on entries are combined; a service declaring neither is taken
+// to consume every other service on a user-defined network it shares with
+// them. Providers of its contracts are added in any case. Targets outside
+// the project are skipped and duplicates dropped.
 func getSvcLinks(p *project.Project) (map[string][]string, error) {
 	links := make(map[string][]string)
 
 	for _, svcName := range p.Configs.Keys() {
 		svc, _ := p.Configs.Get(svcName)
 		log.Debugf("svc %s === %+v ", svcName, svc)
-		svcLinks := svc.Links.Slice()
+
+		targets := []string{}
+		for _, link := range svc.Links.Slice() {
+			targets = append(targets, getLinkTarget(link))
+		}
+		targets = append(targets, svc.DependsOn...)
+
+		if len(targets) == 0 {
+			svcNets := getSvcNetworks(svc)
+			for _, peerName := range p.Configs.Keys() {
+				peer, _ := p.Configs.Get(peerName)
+				for netName := range getSvcNetworks(peer) {
+					if _, ok := svcNets[netName]; ok {
+						targets = append(targets, peerName)
+						break
+					}
+				}
+			}
+		}
+
+		// contracts hold whether or not the services are linked
+		targets = append(targets, getContractProviders(p.Name, svcName, svc)...)
+
+		seen := make(map[string]bool)
+		svcLinks := []string{}
+		for _, target := range targets {
+			toSvcName, ok := resolveSvcName(p, svc, target)
+			if !ok {
+				log.Debugf("Skipping link from '%s' to '%s' outside the project", svcName, target)
+				continue
+			}
+			if toSvcName == svcName || seen[toSvcName] {
+				continue
+			}
+			seen[toSvcName] = true
+			svcLinks = append(svcLinks, toSvcName)
+		}
+		sort.Strings(svcLinks)
+
 		log.Debugf("found links for svc '%s' %#v ", svcName, svcLinks)
 		links[svcName] = svcLinks
 	}
@@ -150,15 +301,56 @@ func extractPort(ps string) string {
 	return ps[lastCol+1:]
 }
 
-func getSvcPorts(p *project.Project) (map[string][]string, error) {
-	sPorts := make(map[string][]string)
-	res := []string{}
+// parsePublishedPort returns the container ports of a published port such
+// as "8080:80", "8000-8010:8000-8010" or "53:53/udp", a range giving one port
+// each, held to the limits of the port ranges of rules
+func parsePublishedPort(svcName, ps string) ([]nat.Port, error) {
+	invalid := func(reason string) error {
+		return fmt.Errorf("%w '%s' of service '%s': %s", ErrInvalidPort, ps, svcName, reason)
+	}
+
+	proto, port := "tcp", extractPort(ps)
+	if slash := strings.Index(port, "/"); slash != -1 {
+		proto, port = port[slash+1:], port[:slash]
+	}
+	if proto != "tcp" && proto != "udp" {
+		return nil, invalid("unknown protocol")
+	}
+	natPort, err := nat.NewPort(proto, port)
+	if err != nil {
+		return nil, invalid(err.Error())
+	}
+	start, end, err := natPort.Range()
+	if err != nil {
+		return nil, invalid(err.Error())
+	}
+	if start == 0 {
+		return nil, invalid("port 0")
+	}
+	if end-start+1 > ops.PORT_RANGE_MAX {
+		return nil, invalid(fmt.Sprintf("range wider than %d ports", ops.PORT_RANGE_MAX))
+	}
+
+	natPorts := []nat.Port{}
+	for portNum := start; portNum <= end; portNum++ {
+		natPorts = append(natPorts, nat.Port(fmt.Sprintf("%d/%s", portNum, proto)))
+	}
+	return natPorts, nil
+}
+
+func getSvcPorts(p *project.Project) (map[string][]nat.Port, error) {
+	sPorts := make(map[string][]nat.Port)
 	for _, svcName := range p.Configs.Keys() {
 		svc, _ := p.Configs.Get(svcName)
 		if len(svc.Ports) > 0 {
+			res := []nat.Port{}
 			pList := svc.Ports
 			for _, ps := range pList {
-				res = append(res, extractPort(ps))
+				natPorts, err := parsePublishedPort(svcName, ps)
+				if err != nil {
+					return nil, err
+				}
+				res = append(res, natPorts...)
 			}
 			sPorts[svcName] = res
 			log.Debugf("Service %v port %v", svcName, sPorts[svcName])
@@ -181,19 +373,20 @@ func clearExposedPorts(p *project.Project) error {
 	return nil
 }
 
-func addDenyAllRule(tenantName, networkName, fromEpgName, policyName string, ruleID int) error {
+// addDenyAllRule denies the traffic of every network, consumers of other
+// networks included, below the rules that allow some of it
+func addDenyAllRule(tenantName, fromEpgName, policyName string) error {
 	rule := &contivClient.Rule{
 		Action:        "deny",
 		Direction:     "in",
 		FromEndpointGroup: fromEpgName,
-		FromNetwork:       networkName,
 		PolicyName:    policyName,
-		Priority:      ruleID,
+		Priority:      RULE_PRIORITY_DENY_ALL,
 		Protocol:      "tcp",
-		RuleID:        getRuleStr(ruleID),
 		TenantName:    tenantName,
 	}
-	if err := cl.RulePost(rule); err != nil {
+	rule.RuleID = getRuleID(rule)
+	if err := backend.RulePost(rule); err != nil {
 		log.Errorf("Unable to create deny all rule %#v. Error: %v", rule, err)
 		return err
 	}
@@ -201,40 +394,46 @@ func addDenyAllRule(tenantName, networkName, fromEpgName, policyName string, rul
 	return nil
 }
 
-func addInAcceptRule(tenantName, networkName, fromEpgName, policyName, protoName string, portID, ruleID int) error {
+// addInAcceptRule allows traffic to a published port
+func addInAcceptRule(tenantName, fromNetworkName, fromEpgName, fromIpAddress, policyName, protoName string, portID int) error {
+	return addInRule(tenantName, fromNetworkName, fromEpgName, fromIpAddress, policyName, "allow", protoName, portID, RULE_PRIORITY_EXPOSE)
+}
+
+func addInRule(tenantName, fromNetworkName, fromEpgName, fromIpAddress, policyName, action, protoName string, portID, priority int) error {
 	rule := &contivClient.Rule{
-		Action:        "allow",
+		Action:        action,
 		Direction:     "in",
 		FromEndpointGroup: fromEpgName,
-		FromNetwork:       networkName,
+		FromIpAddress:     fromIpAddress,
+		FromNetwork:       fromNetworkName,
 		PolicyName:    policyName,
 		Port:          portID,
-		Priority:      ruleID,
+		Priority:      priority,
 		Protocol:      protoName,
-		RuleID:        getRuleStr(ruleID),
 		TenantName:    tenantName,
 	}
-	if err := cl.RulePost(rule); err != nil {
-		log.Errorf("Unable to create allow rule %#v. Error: %v", rule, err)
+	rule.RuleID = getRuleID(rule)
+	if err := backend.RulePost(rule); err != nil {
+		log.Errorf("Unable to create %s rule %#v. Error: %v", action, rule, err)
 		return err
 	}
 
 	return nil
 }
 
-func addOutAcceptAllRule(tenantName, networkName, fromEpgName, policyName string, ruleID int) error {
+func addOutAcceptAllRule(tenantName, networkName, fromEpgName, policyName string) error {
 	rule := &contivClient.Rule{
 		Action:        "allow",
 		Direction:     "out",
 		FromEndpointGroup: fromEpgName,
 		FromNetwork:       networkName,
 		PolicyName:    policyName,
-		Priority:      ruleID,
+		Priority:      RULE_PRIORITY_ALLOW_ALL,
 		Protocol:      "tcp",
-		RuleID:        getRuleStr(ruleID),
 		TenantName:    tenantName,
 	}
-	if err := cl.RulePost(rule); err != nil {
+	rule.RuleID = getRuleID(rule)
+	if err := backend.RulePost(rule); err != nil {
 		log.Errorf("Unable to create allow rule %#v. Error: %v", rule, err)
 		return err
 	}
@@ -242,12 +441,35 @@ func addOutAcceptAllRule(tenantName, networkName, fromEpgName, policyName string
 	return nil
 }
 
+func addDenyAllOutRule(tenantName, policyName string) error {
+	return addOutRule(tenantName, policyName, "deny", "tcp", 0, RULE_PRIORITY_DENY_ALL)
+}
+
+func addOutRule(tenantName, policyName, action, protoName string, portID, priority int) error {
+	rule := &contivClient.Rule{
+		Action:     action,
+		Direction:  "out",
+		PolicyName: policyName,
+		Port:       portID,
+		Priority:   priority,
+		Protocol:   protoName,
+		TenantName: tenantName,
+	}
+	rule.RuleID = getRuleID(rule)
+	if err := backend.RulePost(rule); err != nil {
+		log.Errorf("Unable to create %s out rule %#v. Error: %v", action, rule, err)
+		return err
+	}
+
+	return nil
+}
+
 func addPolicy(tenantName, policyName string) error {
 	policy := &contivClient.Policy{
 		PolicyName: policyName,
 		TenantName: tenantName,
 	}
-	if err := cl.PolicyPost(policy); err != nil {
+	if err := backend.PolicyPost(policy); err != nil {
 		log.Debugf("Unable to create policy rule. Error: %v", err)
 		return err
 	}
@@ -255,22 +477,27 @@ func addPolicy(tenantName, policyName string) error {
 	return nil
 }
 
-func addApp(tenantName string, p *project.Project) error {
+// addApp groups the epgs of the services on networkName into an app profile
+func addApp(tenantName, networkName string, p *project.Project) error {
 
-	log.Debugf("Add App '%s':'%s' ", tenantName, p.Name)
+	log.Debugf("Add App '%s':'%s' on network '%s'", tenantName, p.Name, networkName)
 	app := &contivClient.AppProfile{
 		AppProfileName: p.Name,
 		TenantName: tenantName,
-		NetworkName: getNetworkNameFromProject(p),
+		NetworkName: networkName,
 	}
 
 	for _, svcName := range p.Configs.Keys() {
+		svc, _ := p.Configs.Get(svcName)
+		if getNetworkName(svc) != networkName {
+			continue
+		}
 		epgKey := getSvcName(p, svcName)
 		app.EndpointGroups = append(app.EndpointGroups, epgKey)
 		log.Debugf("Adding epg to App:%s ", epgKey)
 	}
 
-	if err := cl.AppProfilePost(app); err != nil {
+	if err := backend.AppProfilePost(app); err != nil {
 		log.Debugf("Unable to post app to netmaster. Error: %v", err)
 		return err
 	}
@@ -278,11 +505,11 @@ func addApp(tenantName string, p *project.Project) error {
 	return nil
 }
 
-func deleteApp(tenantName string, p *project.Project) error {
+func deleteApp(tenantName, networkName string, p *project.Project) error {
 
-	log.Debugf("Deleting App '%s':'%s' ", tenantName, p.Name)
+	log.Debugf("Deleting App '%s':'%s' on network '%s'", tenantName, p.Name, networkName)
 
-	if err := cl.AppProfileDelete(tenantName, getNetworkNameFromProject(p), p.Name); err != nil {
+	if err := backend.AppProfileDelete(tenantName, networkName, p.Name); err != nil {
 		log.Debugf("Unable to post app delete to netmaster. Error: %v", err)
 		return err
 	}
@@ -298,7 +525,7 @@ func addEpg(tenantName, networkName, epgName string, policies []string) error {
 		Policies:        policies,
 		TenantName:      tenantName,
 	}
-	if err := cl.EndpointGroupPost(epg); err != nil {
+	if err := backend.EndpointGroupPost(epg); err != nil {
 		log.Errorf("Unable to create endpoint group. Tenant '%s' Network '%s' Epg '%s'. Error %v",
 			tenantName, networkName, epgName, err)
 		return err
@@ -336,7 +563,6 @@ func applyDefaultPolicy(p *project.Project, polRecs map[string]policyCreateRec)
 		}
 
 		// add 'in' policy for the service tier
-		ruleID := 1
 		policyName := getInPolicyStr(p.Name, svcName)
 		policies := []string{}
 
@@ -347,19 +573,18 @@ func applyDefaultPolicy(p *project.Project, polRecs map[string]policyCreateRec)
 		}
 		policies = append(policies, policyName)
 
-		if err := addDenyAllRule(tenantName, networkName, "", policyName, ruleID); err != nil {
+		if err := addDenyAllRule(tenantName, "", policyName); err != nil {
 			log.Errorf("Unable to add deny rule. Error %v ", err)
 			return err
 		}
 
 		// add 'out' policy for the service tier
-		ruleID = 1
 		policyName = getOutPolicyStr(p.Name, svcName)
 		if err := addPolicy(tenantName, policyName); err != nil {
 			log.Errorf("Unable to add policy. Error %v", err)
 		}
 		policies = append(policies, policyName)
-		if err := addOutAcceptAllRule(tenantName, networkName, "", policyName, ruleID); err != nil {
+		if err := addOutAcceptAllRule(tenantName, networkName, "", policyName); err != nil {
 			log.Errorf("Unable to add deny rule. Error %v ", err)
 			return err
 		}
@@ -381,19 +606,18 @@ func getPolicyRec(name string, polRecs map[string]policyCreateRec) policyCreateR
 		return rec
 	}
 
-	rec = policyCreateRec{nextRuleId: 1, policyApplied: false}
+	rec = policyCreateRec{policyApplied: false}
 	polRecs[name] = rec
 	return rec
 }
 
-func applyExposePolicy(p *project.Project, expMap map[string][]string, polRecs map[string]policyCreateRec) error {
+func applyExposePolicy(p *project.Project, principal identity.Principal, expMap map[string][]nat.Port, polRecs map[string]policyCreateRec) error {
 
 	tenantName := getTenantNameFromProject(p)
 	for toSvcName, spList := range expMap {
 		svc, _ := p.Configs.Get(toSvcName)
 		networkName := getNetworkName(svc)
 		policyRec := getPolicyRec(toSvcName, polRecs)
-		ruleID := policyRec.nextRuleId
 		policyName := getInPolicyStr(p.Name, toSvcName)
 		// create the policy, if necessary
 		if !policyRec.policyApplied && (len(spList) > 0) {
@@ -410,28 +634,65 @@ func applyExposePolicy(p *project.Project, expMap map[string][]string, polRecs m
 			}
 		}
 
+		fromCIDRs, err := getExposeFrom(principal, svc)
+		if err != nil {
+			log.Errorf("Unable to get sources allowed to service '%s'. Error %v", toSvcName, err)
+			return err
+		}
+		fromNetworkName := networkName
+		if len(fromCIDRs) > 0 {
+			fromNetworkName = ""
+		} else {
+			// anyone
+			fromCIDRs = []string{""}
+		}
+
 		for _, portID := range spList {
-			pNum, err := strconv.Atoi(portID)
-			if err != nil {
-				log.Errorf("Unable to get port number. Error %v ", err)
+			pNum := portID.Int()
+			for _, fromCIDR := range fromCIDRs {
+				if err = addInAcceptRule(tenantName, fromNetworkName, "", fromCIDR, policyName, portID.Proto(), pNum); err != nil {
+					log.Errorf("Unable to add allow rule. Error %v ", err)
+					return err
+				} else {
+					log.Debugf("Exposed %v : port %v to '%s'", policyName, portID, fromCIDR)
+				}
 			}
+		}
+	}
 
-			if err = addInAcceptRule(tenantName, networkName, "", policyName, "tcp", pNum, ruleID); err != nil {
-				log.Errorf("Unable to add allow rule. Error %v ", err)
-				return err
-			} else {
-				log.Debugf("Exposed %v : port %v", policyName, portID)
+	return nil
+}
+
+// getExposeFrom returns the CIDRs published ports of a service are
+// restricted to, from the service label or else from its network policy.
+// No CIDRs means the ports are open to anyone.
+func getExposeFrom(principal identity.Principal, svc *config.ServiceConfig) ([]string, error) {
+	if labels := svc.Labels.MapParts(); labels != nil {
+		if value, ok := labels[EXPOSE_FROM_LABEL]; ok {
+			cidrs := []string{}
+			for _, cidr := range strings.Split(value, ",") {
+				cidr, err := ops.ParseCIDR(strings.TrimSpace(cidr))
+				if err != nil {
+					return nil, err
+				}
+				cidrs = append(cidrs, cidr)
 			}
-			ruleID++
+			return cidrs, nil
 		}
-		policyRec.nextRuleId = ruleID
-		polRecs[toSvcName] = policyRec
 	}
 
-	return nil
+	policyName, err := getPolicyName(principal, svc)
+	if errors.Is(err, ops.ErrDefaultNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ops.GetExposeFrom(policyName)
 }
 
-func getPolicyName(userId string, svc *config.ServiceConfig) (string, error) {
+func getPolicyName(principal identity.Principal, svc *config.ServiceConfig) (string, error) {
 	var err error
 
 	policyName := ""
@@ -448,7 +709,7 @@ func getPolicyName(userId string, svc *config.ServiceConfig) (string, error) {
 	}
 
 	if policyName == "" {
-		policyName, err = ops.UserOpsGetDefaultNetworkPolicy(userId)
+		policyName, err = ops.UserOpsGetDefaultNetworkPolicy(principal.Name, principal.Groups...)
 		if err != nil {
 			log.Errorf("Unable to find find default policy: %s", err)
 			return policyName, err
@@ -456,55 +717,163 @@ func getPolicyName(userId string, svc *config.ServiceConfig) (string, error) {
 		log.Infof("Using default policy '%s'...", policyName)
 	}
 
-	if err = ops.UserOpsCheckNetworkPolicy(userId, policyName); err != nil {
-		log.Errorf("User '%s' not allowed to use policy '%s'", userId, policyName)
+	if err = ops.UserOpsCheckNetworkPolicy(principal.Name, policyName, principal.Groups...); err != nil {
+		log.Errorf("User '%s' not allowed to use policy '%s'", principal.Name, policyName)
 		return "", err
 	}
 
 	return policyName, nil
 }
 
-func getServicePorts(svcName string, svc *config.ServiceConfig) ([]nat.Port, error) {
+// getServiceRules returns the ordered rules of the policy applied to a
+// service, with 'app' rules expanded to the ports of the image
+func getServiceRules(principal identity.Principal, svcName string, svc *config.ServiceConfig) ([]ops.Rule, error) {
 
-	userId, err := getSelfId()
+	policyName, err := getPolicyName(principal, svc)
 	if err != nil {
-		log.Errorf("Unable to identify self: %s", err)
-		return []nat.Port{}, err
+		log.Errorf("Error obtaining policy : %s ", err)
+		return []ops.Rule{}, err
 	}
 
-	policyName, err := getPolicyName(userId, svc)
+	policyRules, err := ops.GetRules(policyName)
 	if err != nil {
-		log.Errorf("Error obtaining policy : %s ", err)
-		return []nat.Port{}, err
+		log.Errorf("Unable to get rules for policy '%s': %s", policyName, err)
+		return []ops.Rule{}, err
 	}
 
-	policyPorts, err := ops.GetRules(policyName)
+	log.Infof("User '%s': applying '%s' to service '%s'", principal.Name, policyName, svcName)
+	if origin, ok := ops.PolicyOrigin(policyName); ok {
+		log.Debugf("Policy '%s' defined in the %s layer '%s'", policyName, origin.Layer, origin.File)
+	}
+
+	return expandAppRules(svc, policyRules)
+}
+
+// getServiceEgressRules returns the ordered egress rules of the policy
+// applied to a service; nil when its egress is not restricted
+func getServiceEgressRules(principal identity.Principal, svcName string, svc *config.ServiceConfig) ([]ops.Rule, error) {
+
+	policyName, err := getPolicyName(principal, svc)
+	if errors.Is(err, ops.ErrDefaultNotFound) {
+		return nil, nil
+	}
 	if err != nil {
-		log.Errorf("Unable to get rules for policy '%s': %s", policyName, err)
-		return []nat.Port{}, err
+		log.Errorf("Error obtaining policy : %s ", err)
+		return nil, err
 	}
 
-	log.Infof("User '%s': applying '%s' to service '%s'", userId, policyName, svcName)
+	policyRules, err := ops.GetEgressRules(policyName)
+	if err != nil || policyRules == nil {
+		return nil, err
+	}
 
-	natPorts := []nat.Port{}
-	for _, policyPort := range policyPorts {
+	log.Infof("User '%s': applying egress of '%s' to service '%s'", principal.Name, policyName, svcName)
+
+	return expandAppRules(svc, policyRules)
+}
+
+// expandAppRules replaces 'app' rules by rules on the ports of the image
+func expandAppRules(svc *config.ServiceConfig, policyRules []ops.Rule) ([]ops.Rule, error) {
+	rules := []ops.Rule{}
+	for _, policyRule := range policyRules {
 		// borrow port information from the app
-		if policyPort.Proto() == "app" {
-			natPorts1, err := getImageInfo(svc.Image)
+		if policyRule.Proto() == "app" {
+			natPorts, err := getImageInfo(svc.Image)
 			if err != nil {
 				log.Errorf("Unable to auto fetch port/protocol information. Error %v", err)
-				return []nat.Port{}, err
+				return []ops.Rule{}, err
+			}
+			for _, natPort := range natPorts {
+				rules = append(rules, ops.Rule{Action: policyRule.Action, Index: policyRule.Index, Port: natPort})
 			}
-			natPorts = append(natPorts, natPorts1...)
 		} else {
-			natPorts = append(natPorts, policyPort)
+			rules = append(rules, policyRule)
 		}
 	}
 
-	return natPorts, nil
+	return rules, nil
+}
+
+// portRule is a rule on a single port, or on any port when port is 0
+type portRule struct {
+	action string
+	proto  string
+	port   int
+	index  int
+}
+
+// contivAction maps the ops.json action onto the netmaster one
+func (r portRule) contivAction() string {
+	if r.action == "deny" {
+		return "deny"
+	}
+	return "allow"
 }
 
-func applyInPolicy(p *project.Project, fromSvcName, toSvcName string, polRecs map[string]policyCreateRec) error {
+// contivProto returns the netmaster protocol, empty matching all of them
+func (r portRule) contivProto() string {
+	if r.proto == "all" {
+		return ""
+	}
+	return r.proto
+}
+
+// expandRules turns the policy rules into the single port rules netmaster
+// understands. Ports already matched by an earlier rule of the same
+// protocol are left out, and a range spanning all ports becomes any port.
+func expandRules(rules []ops.Rule) []portRule {
+	anyPort := make(map[string]bool)
+	covered := make(map[string]map[int]bool)
+	portRules := []portRule{}
+
+	for _, rule := range rules {
+		proto := rule.Proto()
+		if anyPort[proto] {
+			continue
+		}
+
+		start, end, _ := rule.Range()
+		if (start == 0 && end == 0) || (start <= 1 && end == 65535) {
+			anyPort[proto] = true
+			portRules = append(portRules, portRule{action: rule.Action, proto: proto, index: rule.Index})
+			continue
+		}
+
+		if covered[proto] == nil {
+			covered[proto] = make(map[int]bool)
+		}
+		if start == 0 {
+			// port 0 stands for any port in netmaster, not a bound
+			start = 1
+		}
+		for port := start; port <= end; port++ {
+			if covered[proto][port] {
+				continue
+			}
+			covered[proto][port] = true
+			portRules = append(portRules, portRule{action: rule.Action, proto: proto, port: port, index: rule.Index})
+		}
+	}
+
+	return portRules
+}
+
+// allowsAll tells if the rules let all traffic through, i.e. they permit
+// all protocols and deny nothing
+func allowsAll(rules []ops.Rule) bool {
+	permitAll := false
+	for _, rule := range rules {
+		if rule.Action == "deny" {
+			return false
+		}
+		if rule.Proto() == "all" {
+			permitAll = true
+		}
+	}
+	return permitAll
+}
+
+func applyInPolicy(p *project.Project, principal identity.Principal, fromSvcName, toSvcName string, polRecs map[string]policyCreateRec) error {
 	svc,_ := p.Configs.Get(toSvcName)
 
 	policyRec := getPolicyRec(toSvcName, polRecs)
@@ -514,17 +883,26 @@ func applyInPolicy(p *project.Project, fromSvcName, toSvcName string, polRecs ma
 
 	policyName := getInPolicyStr(p.Name, toSvcName)
 	fromEpgName := getFromEpgName(p, fromSvcName)
+	fromSvc, _ := p.Configs.Get(fromSvcName)
+	fromNetworkName := getNetworkName(fromSvc)
 
-	ruleID := policyRec.nextRuleId
 	policies := []string{}
 
-	natPorts, err := getServicePorts(toSvcName, svc)
+	rules, override, err := getLinkRules(p, principal, fromSvcName, toSvcName)
 	if err != nil {
 		return err
 	}
+	rulePriority := getPolicyRulePriority
+	if override {
+		rulePriority = getOverrideRulePriority
+	}
 
-	for _, natPort := range natPorts {
-		if natPort.Proto() == "all" {
+	if allowsAll(rules) {
+		restricted, err := isProviderRestricted(p, principal, toSvcName)
+		if err != nil {
+			return err
+		}
+		if !restricted {
 			log.Infof("Allowing all traffic to service '%s'", toSvcName)
 			return nil
 		}
@@ -538,18 +916,23 @@ func applyInPolicy(p *project.Project, fromSvcName, toSvcName string, polRecs ma
 	}
 	policies = append(policies, policyName)
 
-	if err := addDenyAllRule(tenantName, networkName, "", policyName, ruleID); err != nil {
-		return err
+	// a single deny all at the bottom, shared by all consumers
+	if !policyRec.policyApplied {
+		if err := addDenyAllRule(tenantName, "", policyName); err != nil {
+			return err
+		}
 	}
-	ruleID++
 
-	for _, natPort := range natPorts {
-		pNum, _ := strconv.Atoi(natPort.Port())
-		if err := addInAcceptRule(tenantName, networkName, fromEpgName, policyName, natPort.Proto(), pNum, ruleID); err != nil {
-			log.Errorf("Unable to add allow rule. Error %v ", err)
+	for _, rule := range expandRules(rules) {
+		action, protoName := rule.contivAction(), rule.contivProto()
+		priority, err := rulePriority(rule.index)
+		if err != nil {
+			return fmt.Errorf("service '%s': %s", toSvcName, err)
+		}
+		if err := addInRule(tenantName, fromNetworkName, fromEpgName, "", policyName, action, protoName, rule.port, priority); err != nil {
+			log.Errorf("Unable to add %s rule. Error %v ", action, err)
 			return err
 		}
-		ruleID++
 	}
 
 	if err := addEpg(tenantName, networkName, toEpgName, policies); err != nil {
@@ -557,12 +940,68 @@ func applyInPolicy(p *project.Project, fromSvcName, toSvcName string, polRecs ma
 		return err
 	}
 
-	policyRec.nextRuleId = ruleID
 	policyRec.policyApplied = true
 	polRecs[toSvcName] = policyRec
 	return nil
 }
 
+// applyOutPolicy attaches an 'out' policy to each service whose network
+// policy restricts egress
+func applyOutPolicy(p *project.Project, principal identity.Principal) error {
+	tenantName := getTenantNameFromProject(p)
+	for _, svcName := range p.Configs.Keys() {
+		svc, _ := p.Configs.Get(svcName)
+
+		rules, err := getServiceEgressRules(principal, svcName, svc)
+		if err != nil {
+			return err
+		}
+		if rules == nil || allowsAll(rules) {
+			continue
+		}
+
+		networkName := getNetworkName(svc)
+		epgName := getSvcName(p, svcName)
+		policyName := getOutPolicyStr(p.Name, svcName)
+
+		log.Debugf("Restricting egress of service '%s'", svcName)
+		if err := addPolicy(tenantName, policyName); err != nil {
+			log.Errorf("Unable to add policy. Error %v ", err)
+			return err
+		}
+
+		if err := addDenyAllOutRule(tenantName, policyName); err != nil {
+			return err
+		}
+
+		for _, rule := range expandRules(rules) {
+			action, protoName := rule.contivAction(), rule.contivProto()
+			priority, err := getPolicyRulePriority(rule.index)
+			if err != nil {
+				return fmt.Errorf("egress of service '%s': %s", svcName, err)
+			}
+			if err := addOutRule(tenantName, policyName, action, protoName, rule.port, priority); err != nil {
+				log.Errorf("Unable to add %s out rule. Error %v ", action, err)
+				return err
+			}
+		}
+
+		// keep the policies the epg already has
+		epg, err := backend.EndpointGroupGet(tenantName, networkName, epgName)
+		if err != nil {
+			log.Errorf("Unable to get epg '%s'. Error %v", epgName, err)
+			return err
+		}
+		policies := append(append([]string{}, epg.Policies...), policyName)
+		if err := addEpg(tenantName, networkName, epgName, policies); err != nil {
+			log.Errorf("Unable to add epg. Error %v", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
 func removePolicy(p *project.Project, svcName, dir string) error {
 	log.Debugf("Deleting policies for service '%s' ", svcName)
 	tenantName := getTenantNameFromProject(p)
@@ -571,7 +1010,7 @@ func removePolicy(p *project.Project, svcName, dir string) error {
 		policyName = getOutPolicyStr(p.Name, svcName)
 	}
 
-	if err := cl.PolicyDelete(tenantName, policyName); err != nil {
+	if err := backend.PolicyDelete(tenantName, policyName); err != nil {
 		log.Debugf("Unable to delete '%s' policy. Error: %v", policyName, err)
 	}
 
@@ -586,7 +1025,7 @@ func removeEpg(p *project.Project, svcName string) error {
 	networkName := getNetworkName(svc)
 	epgName := getSvcName(p, svcName)
 
-	if err := cl.EndpointGroupDelete(tenantName, networkName, epgName); err != nil {
+	if err := backend.EndpointGroupDelete(tenantName, networkName, epgName); err != nil {
 		log.Debugf("Unable to delete '%s' epg. Error: %v", epgName, err)
 	}
 
@@ -0,0 +1,1087 @@
+package nethooks
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	contivClient "github.com/contiv/contivmodel/client"
+	"github.com/docker/go-connections/nat"
+	"github.com/docker/libcompose/deploy/identity"
+	"github.com/docker/libcompose/deploy/ops"
+	"github.com/docker/libcompose/docker"
+	"github.com/docker/libcompose/project"
+)
+
+// testPrincipal stands in for the user resolved by the identity provider
+var testPrincipal = identity.Principal{Name: "tester", Source: "test"}
+
+func loadTestOps(t *testing.T, jsonData string, composeFiles ...string) {
+	tmpfile, err := ioutil.TempFile("", "ops")
+	if err != nil {
+		t.Fatalf("error creating a tmp file")
+	}
+	defer os.Remove(tmpfile.Name())
+
+	jsonData = strings.Replace(jsonData, "$USER", testPrincipal.Name, -1)
+	if err := ioutil.WriteFile(tmpfile.Name(), []byte(jsonData), 0644); err != nil {
+		t.Fatalf("error writing to tmp file %#v", err)
+	}
+
+	if err := ops.LoadOpsFile(tmpfile.Name(), composeFiles...); err != nil {
+		t.Fatalf("error loading ops file: %s", err)
+	}
+}
+
+func newTestProject(t *testing.T, yamlData string) *project.Project {
+	writeTmpFile(t, []byte(yamlData))
+	defer removeTmpFile(t)
+
+	p, err := docker.NewProject(&docker.Context{
+		Context: project.Context{
+			ComposeFiles: []string{composeFile},
+			ProjectName:  "example",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to create a project. Error %v\n", err)
+	}
+
+	return p
+}
+
+const testOps = `
+	{
+	"UserPolicy" : [
+		{ "User":"$USER",
+		  "Networks": "all",
+		  "NetworkPolicies": "all",
+		  "DefaultNetworkPolicy": "AllPriviliges" } ],
+	"NetworkPolicy" : [
+		{ "Name":"AllPriviliges", "Rules": ["permit all"] },
+		{ "Name":"RedisDefault", "Rules": ["permit tcp/6379", "permit tcp/6378"] },
+		{ "Name":"RedisSingle", "Rules": ["permit tcp/6379"] } ]
+	}
+`
+
+const testCompose = `
+            web:
+              image: web
+              ports:
+               - "5000:5000"
+              links:
+               - redis
+            redis:
+              image: redis
+              labels:
+                io.contiv.policy: "RedisDefault"
+            `
+
+func TestCreateNetConfig(t *testing.T) {
+	loadTestOps(t, testOps)
+	p := newTestProject(t, testCompose)
+
+	b := NewMemBackend()
+	SetBackend(b)
+	defer SetBackend(nil)
+
+	if err := CreateNetConfig(p, testPrincipal); err != nil {
+		t.Fatalf("Unable to create net config. Error %v", err)
+	}
+
+	for _, epgName := range []string{"example_web", "example_redis"} {
+		if _, err := b.EndpointGroupGet("default", "dev", epgName); err != nil {
+			t.Fatalf("epg '%s' not created: %s", epgName, err)
+		}
+	}
+
+	epg, _ := b.EndpointGroupGet("default", "dev", "example_redis")
+	if len(epg.Policies) != 1 || epg.Policies[0] != "example_redis-in" {
+		t.Fatalf("redis epg has unexpected policies %v", epg.Policies)
+	}
+
+	rules, _ := b.RuleList()
+	allowed := map[int]bool{}
+	denyAll := false
+	for _, rule := range *rules {
+		if rule.PolicyName != "example_redis-in" {
+			continue
+		}
+		switch rule.Action {
+		case "deny":
+			denyAll = rule.FromEndpointGroup == "" && rule.Port == 0
+		case "allow":
+			if rule.FromEndpointGroup != "example_web" {
+				t.Fatalf("allow rule %#v not restricted to the web tier", rule)
+			}
+			allowed[rule.Port] = true
+		}
+	}
+	if !denyAll || !allowed[6379] || !allowed[6378] || len(allowed) != 2 {
+		t.Fatalf("unexpected redis rules %#v", *rules)
+	}
+
+	if _, err := b.RuleGet("default", "example_web-in", "in-allow-tcp-5000-from-net-dev"); err != nil {
+		t.Fatalf("expose rule for web not created: %s", err)
+	}
+
+	app, err := b.AppProfileGet("default", "dev", "example")
+	if err != nil {
+		t.Fatalf("app profile not created: %s", err)
+	}
+	if len(app.EndpointGroups) != 2 {
+		t.Fatalf("app profile has unexpected epgs %v", app.EndpointGroups)
+	}
+
+	if err := DeleteNetConfig(p, testPrincipal); err != nil {
+		t.Fatalf("Unable to delete net config. Error %v", err)
+	}
+
+	epgs, _ := b.EndpointGroupList()
+	policies, _ := b.PolicyList()
+	rules, _ = b.RuleList()
+	if len(*epgs) != 0 || len(*policies) != 0 || len(*rules) != 0 {
+		t.Fatalf("objects left behind after delete: %v %v %v", *epgs, *policies, *rules)
+	}
+}
+
+func TestMultiNetworkNetConfig(t *testing.T) {
+	loadTestOps(t, testOps)
+	p := newTestProject(t, `
+            web:
+              image: web
+              links:
+               - redis
+              labels:
+                io.contiv.network: "frontend"
+            redis:
+              image: redis
+              labels:
+                io.contiv.network: "backend"
+                io.contiv.policy: "RedisSingle"
+            `)
+
+	b := NewMemBackend()
+	SetBackend(b)
+	defer SetBackend(nil)
+
+	if err := CreateNetConfig(p, testPrincipal); err != nil {
+		t.Fatalf("Unable to create net config. Error %v", err)
+	}
+
+	if _, err := b.EndpointGroupGet("default", "frontend", "example_web"); err != nil {
+		t.Fatalf("web epg not created on frontend: %s", err)
+	}
+	if _, err := b.EndpointGroupGet("default", "backend", "example_redis"); err != nil {
+		t.Fatalf("redis epg not created on backend: %s", err)
+	}
+
+	rules, _ := b.RuleList()
+	found := false
+	for _, rule := range *rules {
+		if rule.PolicyName == "example_redis-in" && rule.Action == "allow" {
+			if rule.FromEndpointGroup != "example_web" || rule.FromNetwork != "frontend" {
+				t.Fatalf("cross network rule %#v not from the web tier", rule)
+			}
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("no allow rule for redis in %#v", *rules)
+	}
+
+	// what is not allowed from the frontend is denied too
+	denied := false
+	for _, rule := range *rules {
+		if rule.PolicyName == "example_redis-in" && rule.Action == "deny" && rule.Port == 0 &&
+			rule.FromEndpointGroup == "" && rule.FromIpAddress == "" &&
+			(rule.FromNetwork == "" || rule.FromNetwork == "frontend") {
+			denied = true
+		}
+	}
+	if !denied {
+		t.Fatalf("no deny all rule of redis covering the frontend in %#v", *rules)
+	}
+
+	for _, networkName := range []string{"frontend", "backend"} {
+		app, err := b.AppProfileGet("default", networkName, "example")
+		if err != nil {
+			t.Fatalf("app profile not created on '%s': %s", networkName, err)
+		}
+		if len(app.EndpointGroups) != 1 {
+			t.Fatalf("app profile on '%s' has unexpected epgs %v", networkName, app.EndpointGroups)
+		}
+	}
+
+	if err := DeleteNetConfig(p, testPrincipal); err != nil {
+		t.Fatalf("Unable to delete net config. Error %v", err)
+	}
+	apps, _ := b.AppProfileList()
+	epgs, _ := b.EndpointGroupList()
+	if len(*apps) != 0 || len(*epgs) != 0 {
+		t.Fatalf("objects left behind after delete: %v %v", *apps, *epgs)
+	}
+}
+
+func TestCheckUserCreds(t *testing.T) {
+	loadTestOps(t, `{ "UserPolicy" : [ { "User":"$USER", "Networks": "test" } ] }`)
+	p := newTestProject(t, testCompose)
+
+	if err := checkUserCreds(p, testPrincipal); err == nil {
+		t.Fatalf("user allowed on a network not in the ops policy")
+	}
+
+	SetBackend(NewMemBackend())
+	defer SetBackend(nil)
+
+	err := CreateNetConfig(p, testPrincipal)
+	if !errors.Is(err, ops.ErrNetworkDenied) {
+		t.Fatalf("unexpected error for a denied network: %v", err)
+	}
+	authzErr := &ops.AuthzError{}
+	if !errors.As(err, &authzErr) || authzErr.Name != "dev" {
+		t.Fatalf("denied network not reported: %v", err)
+	}
+
+	// every network of the composition needs to be allowed
+	p = newTestProject(t, `
+            web:
+              image: web
+              net: test
+            redis:
+              image: redis
+              net: dev
+            `)
+	if err := checkUserCreds(p, testPrincipal); !errors.Is(err, ops.ErrNetworkDenied) {
+		t.Fatalf("user allowed on a network not in the ops policy: %v", err)
+	}
+
+	// networks granted to a group of the user
+	loadTestOps(t, `{ "UserPolicy" : [ { "Group":"db", "Networks": "test,dev" } ] }`)
+	member := identity.Principal{Name: testPrincipal.Name, Groups: []string{"web", "db"}}
+	if err := checkUserCreds(p, member); err != nil {
+		t.Fatalf("user denied a network of its group: %s", err)
+	}
+	if err := checkUserCreds(p, testPrincipal); !errors.Is(err, ops.ErrNetworkDenied) {
+		t.Fatalf("user allowed on a network of a group it is not in: %v", err)
+	}
+}
+
+func TestTenantCreds(t *testing.T) {
+	loadTestOps(t, `{ "UserPolicy" : [ { "User":"$USER", "Tenants": "default,blue", "DefaultTenant": "blue",
+		"Networks": "all", "NetworkPolicies": "all", "DefaultNetworkPolicy": "AllPriviliges" } ],
+		"NetworkPolicy" : [ { "Name":"AllPriviliges", "Rules": ["permit all"] },
+		{ "Name":"RedisDefault", "Rules": ["permit tcp/6379"] } ] }`)
+
+	SetBackend(NewMemBackend())
+	defer SetBackend(nil)
+
+	// a service without a tenant label goes to the default tenant of the user
+	p := newTestProject(t, testCompose)
+	if _, err := PlanNetConfig(p, testPrincipal); err != nil {
+		t.Fatalf("error planning network config: %s", err)
+	}
+	svc, _ := p.Configs.Get("web")
+	if _, ok := svc.Labels.MapParts()[TENANT_LABEL]; ok {
+		t.Fatalf("plan left a tenant label on the project")
+	}
+	if err := CreateNetConfig(p, testPrincipal); err != nil {
+		t.Fatalf("error creating network config: %s", err)
+	}
+	if tenantName := getTenantNameFromProject(p); tenantName != "blue" {
+		t.Fatalf("default tenant of the user not used: '%s'", tenantName)
+	}
+
+	p = newTestProject(t, `
+            web:
+              image: web
+              labels:
+                io.contiv.tenant: "red"
+            `)
+	err := CreateNetConfig(p, testPrincipal)
+	authzErr := &ops.AuthzError{}
+	if !errors.Is(err, ops.ErrTenantDenied) || !errors.As(err, &authzErr) || authzErr.Name != "red" {
+		t.Fatalf("unexpected error for a denied tenant: %v", err)
+	}
+	if err := DeleteNetConfig(p, testPrincipal); !errors.Is(err, ops.ErrTenantDenied) {
+		t.Fatalf("unexpected error deleting from a denied tenant: %v", err)
+	}
+}
+
+func TestComposePolicy(t *testing.T) {
+	writeTmpFile(t, []byte(`
+version: "2"
+services:
+  web:
+    image: web
+    labels:
+      io.contiv.policy: "WebLocal"
+x-contiv-policy:
+  NetworkPolicy:
+    - Name: WebLocal
+      Rules: [ "permit tcp/8080" ]
+`))
+	defer removeTmpFile(t)
+
+	loadTestOps(t, `{ "UserPolicy" : [ { "User":"$USER", "Networks": "all", "NetworkPolicies": "WebLocal" },
+		{ "User":"other", "Networks": "all", "NetworkPolicies": "all", "DefaultNetworkPolicy": "AllPriviliges" },
+		{ "User":"guest", "Networks": "all", "NetworkPolicies": "AllPriviliges" } ],
+		"NetworkPolicy" : [ { "Name":"AllPriviliges", "Rules": ["permit all"] } ] }`, composeFile)
+
+	p, err := docker.NewProject(&docker.Context{
+		Context: project.Context{
+			ComposeFiles: []string{composeFile},
+			ProjectName:  "example",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to create a project. Error %v\n", err)
+	}
+	svc, _ := p.Configs.Get("web")
+
+	rules, err := getServiceRules(testPrincipal, "web", svc)
+	if err != nil || len(rules) != 1 || rules[0].Int() != 8080 {
+		t.Fatalf("policy of the compose file not applied: %v %v", rules, err)
+	}
+	if _, err := getServiceRules(identity.Principal{Name: "other"}, "web", svc); err != nil {
+		t.Fatalf("user allowed all policies denied the policy of the compose file: %s", err)
+	}
+	// policies of the compose file are granted like the others
+	if _, err := getServiceRules(identity.Principal{Name: "guest"}, "web", svc); !errors.Is(err, ops.ErrPolicyDenied) {
+		t.Fatalf("policy of the compose file used without permission: %v", err)
+	}
+}
+
+func TestCreateNetConfigNoBackend(t *testing.T) {
+	loadTestOps(t, testOps)
+
+	err := CreateNetConfig(newTestProject(t, testCompose), testPrincipal)
+	if !errors.Is(err, ErrBackendUnavailable) {
+		t.Fatalf("unexpected error without a backend: %v", err)
+	}
+}
+
+func TestGetSvcLinks(t *testing.T) {
+	p := newTestProject(t, `
+            version: "2"
+            services:
+              web:
+                image: web
+                links:
+                 - redis:db
+                 - redis
+                depends_on:
+                 - redis
+                 - worker
+              worker:
+                image: worker
+                depends_on:
+                 - web
+                 - external
+              redis:
+                image: redis
+                networks:
+                  back:
+                    aliases:
+                     - cache
+              api:
+                image: api
+                networks:
+                 - back
+              proxy:
+                image: proxy
+                links:
+                 - cache
+                networks:
+                 - back
+            `)
+
+	links, err := getSvcLinks(p)
+	if err != nil {
+		t.Fatalf("Unable to get links. Error %v", err)
+	}
+
+	expLinks := map[string][]string{
+		"web":    {"redis", "worker"},
+		"worker": {"web"},
+		"redis":  {"api", "proxy"},
+		"api":    {"proxy", "redis"},
+		"proxy":  {"redis"},
+	}
+	for svcName, expSvcLinks := range expLinks {
+		if !sameStrings(links[svcName], expSvcLinks) {
+			t.Fatalf("links of '%s': got %v, expected %v", svcName, links[svcName], expSvcLinks)
+		}
+	}
+}
+
+func TestDenyRules(t *testing.T) {
+	loadTestOps(t, `
+	{
+	"UserPolicy" : [
+		{ "User":"$USER", "Networks": "all", "NetworkPolicies": "all" } ],
+	"NetworkPolicy" : [
+		{ "Name":"NoSsh", "Rules": ["deny tcp/22", "permit tcp/any"] } ]
+	}
+	`)
+	p := newTestProject(t, `
+            web:
+              image: web
+              links:
+               - db
+            db:
+              image: db
+              labels:
+                io.contiv.policy: "NoSsh"
+            `)
+
+	b := NewMemBackend()
+	SetBackend(b)
+	defer SetBackend(nil)
+
+	if err := CreateNetConfig(p, testPrincipal); err != nil {
+		t.Fatalf("Unable to create net config. Error %v", err)
+	}
+
+	var denySsh, allowAny, denyAll *contivClient.Rule
+	rules, _ := b.RuleList()
+	for _, rule := range *rules {
+		if rule.PolicyName != "example_db-in" {
+			continue
+		}
+		switch {
+		case rule.Action == "deny" && rule.Port == 22:
+			denySsh = rule
+		case rule.Action == "allow" && rule.Port == 0:
+			allowAny = rule
+		case rule.Action == "deny" && rule.FromEndpointGroup == "":
+			denyAll = rule
+		}
+	}
+	if denySsh == nil || allowAny == nil || denyAll == nil {
+		t.Fatalf("unexpected db rules %#v", *rules)
+	}
+	if denySsh.FromEndpointGroup != "example_web" {
+		t.Fatalf("deny rule %#v not restricted to the web tier", denySsh)
+	}
+	if !(denySsh.Priority > allowAny.Priority && allowAny.Priority > denyAll.Priority) {
+		t.Fatalf("rules out of order: deny %d, allow %d, deny all %d",
+			denySsh.Priority, allowAny.Priority, denyAll.Priority)
+	}
+}
+
+func TestContracts(t *testing.T) {
+	loadTestOps(t, `
+	{
+	"UserPolicy" : [
+		{ "User":"$USER", "Networks": "all", "NetworkPolicies": "all" } ],
+	"NetworkPolicy" : [
+		{ "Name":"RedisDefault", "Rules": ["permit tcp/6379,6380,6381"] } ],
+	"Contracts" : [
+		{ "Consumer":"web", "Provider":"redis", "Rules": ["permit tcp/6379"] },
+		{ "Consumer":"worker", "Provider":"redis", "Rules": ["permit tcp/6381"] },
+		{ "Project":"example", "Consumer":"worker", "Provider":"redis", "Rules": ["permit tcp/6379,6380"] },
+		{ "Project":"other", "Consumer":"web", "Provider":"worker", "Rules": ["permit all"] } ]
+	}
+	`)
+	p := newTestProject(t, `
+            web:
+              image: web
+              links:
+               - redis
+            worker:
+              image: worker
+            cli:
+              image: cli
+              labels:
+                io.contiv.contract.redis: "permit tcp/6381"
+            redis:
+              image: redis
+              labels:
+                io.contiv.policy: "RedisDefault"
+            `)
+
+	// contracts hold without links
+	links, err := getSvcLinks(p)
+	if err != nil {
+		t.Fatalf("Unable to get links. Error %v", err)
+	}
+	if !sameStrings(links["worker"], []string{"redis"}) || !sameStrings(links["cli"], []string{"redis"}) {
+		t.Fatalf("contracts not linked: %v", links)
+	}
+	// the contract of another project does not hold here
+	if !sameStrings(links["web"], []string{"redis"}) {
+		t.Fatalf("contract of another project linked: %v", links)
+	}
+
+	b := NewMemBackend()
+	SetBackend(b)
+	defer SetBackend(nil)
+
+	if err := CreateNetConfig(p, testPrincipal); err != nil {
+		t.Fatalf("Unable to create net config. Error %v", err)
+	}
+
+	ports := make(map[string][]int)
+	rules, _ := b.RuleList()
+	for _, rule := range *rules {
+		if rule.PolicyName == "example_redis-in" && rule.Action == "allow" {
+			ports[rule.FromEndpointGroup] = append(ports[rule.FromEndpointGroup], rule.Port)
+		}
+	}
+	expected := map[string][]int{
+		"example_web":    {6379},
+		"example_worker": {6379, 6380},
+		"example_cli":    {6381},
+	}
+	for epgName, expPorts := range expected {
+		sort.Ints(ports[epgName])
+		if fmt.Sprint(ports[epgName]) != fmt.Sprint(expPorts) {
+			t.Fatalf("ports allowed from '%s': got %v, expected %v", epgName, ports[epgName], expPorts)
+		}
+	}
+
+	// contracts of ops.json take the policy band, those of labels the override band
+	expPriorities := map[string]int{
+		"in-allow-tcp-6379-from-epg-example_web": RULE_PRIORITY_POLICY_MAX,
+		"in-allow-tcp-6381-from-epg-example_cli": RULE_PRIORITY_OVERRIDE_MAX,
+	}
+	for ruleID, priority := range expPriorities {
+		rule, err := b.RuleGet("default", "example_redis-in", ruleID)
+		if err != nil || rule.Priority != priority {
+			t.Fatalf("rule '%s' not created with priority %d: %#v %v", ruleID, priority, rule, err)
+		}
+	}
+
+	// a contract in labels only narrows the policy of the provider
+	p = newTestProject(t, `
+            cli:
+              image: cli
+              labels:
+                io.contiv.contract.redis: "permit tcp/22"
+            redis:
+              image: redis
+              labels:
+                io.contiv.policy: "RedisDefault"
+            `)
+	SetBackend(NewMemBackend())
+	err = CreateNetConfig(p, testPrincipal)
+	authzErr := &ops.AuthzError{}
+	if !errors.Is(err, ops.ErrPolicyDenied) || !errors.As(err, &authzErr) || authzErr.Name != "cli -> redis" {
+		t.Fatalf("contract wider than the policy of the provider applied: %v", err)
+	}
+
+	// consumers of a provider open to all keep their access when another
+	// consumer is restricted by a contract
+	loadTestOps(t, `{ "UserPolicy" : [ { "User":"$USER", "Networks": "all", "NetworkPolicies": "all" } ],
+		"NetworkPolicy" : [ { "Name":"AllPriviliges", "Rules": ["permit all"] } ] }`)
+	p = newTestProject(t, `
+            web:
+              image: web
+              links:
+               - api
+            cli:
+              image: cli
+              labels:
+                io.contiv.contract.api: "permit tcp/80"
+            api:
+              image: api
+              labels:
+                io.contiv.policy: "AllPriviliges"
+            `)
+	b = NewMemBackend()
+	SetBackend(b)
+	if err := CreateNetConfig(p, testPrincipal); err != nil {
+		t.Fatalf("Unable to create net config. Error %v", err)
+	}
+	allowed := make(map[string]string)
+	rules, _ = b.RuleList()
+	for _, rule := range *rules {
+		if rule.PolicyName == "example_api-in" && rule.Action == "allow" {
+			allowed[rule.FromEndpointGroup] = fmt.Sprintf("%s/%d", rule.Protocol, rule.Port)
+		}
+	}
+	if allowed["example_web"] != "/0" || allowed["example_cli"] != "tcp/80" {
+		t.Fatalf("unexpected rules of the api: %v", allowed)
+	}
+}
+
+func TestContractTrust(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ops")
+	if err != nil {
+		t.Fatalf("error creating tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "home"))
+	os.Setenv("XDG_CONFIG_DIRS", filepath.Join(dir, "etc"))
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+	defer os.Unsetenv("XDG_CONFIG_DIRS")
+
+	opsData := `{ "UserPolicy" : [ { "User":"$USER", "Networks": "all", "NetworkPolicies": "all" } ],
+		"NetworkPolicy" : [ { "Name":"RedisDefault", "Rules": ["permit tcp/6379"] } ],
+		"Contracts" : [ { "Consumer":"web", "Provider":"redis", "Rules": ["permit tcp/22"] } ] }`
+	p := newTestProject(t, `
+            web:
+              image: web
+              links:
+               - redis
+            redis:
+              image: redis
+              labels:
+                io.contiv.policy: "RedisDefault"
+            `)
+	SetBackend(NewMemBackend())
+	defer SetBackend(nil)
+
+	// a contract of the project layer only narrows the policy of the provider
+	loadTestOps(t, opsData)
+	err = CreateNetConfig(p, testPrincipal)
+	authzErr := &ops.AuthzError{}
+	if !errors.Is(err, ops.ErrPolicyDenied) || !errors.As(err, &authzErr) || authzErr.Name != "web -> redis" {
+		t.Fatalf("contract of the project layer wider than the policy of the provider applied: %v", err)
+	}
+
+	// one of the operators is applied as is
+	systemFile := filepath.Join(dir, "etc", "contiv", "ops.json")
+	if err := os.MkdirAll(filepath.Dir(systemFile), 0755); err != nil {
+		t.Fatalf("error creating dir: %s", err)
+	}
+	if err := ioutil.WriteFile(systemFile, []byte(strings.Replace(opsData, "$USER", testPrincipal.Name, -1)), 0644); err != nil {
+		t.Fatalf("error writing to tmp file %#v", err)
+	}
+	loadTestOps(t, `{}`)
+	defer ops.UseStore(ops.NewStore(""))
+	b := NewMemBackend()
+	SetBackend(b)
+	if err := CreateNetConfig(p, testPrincipal); err != nil {
+		t.Fatalf("contract of the system layer not applied: %v", err)
+	}
+	if _, err := b.RuleGet("default", "example_redis-in", "in-allow-tcp-22-from-epg-example_web"); err != nil {
+		t.Fatalf("rule of the contract of the system layer not created: %s", err)
+	}
+}
+
+func TestLinkPolicy(t *testing.T) {
+	loadTestOps(t, `
+	{
+	"UserPolicy" : [
+		{ "User":"$USER", "Networks": "all", "NetworkPolicies": "RedisDefault,RedisReadOnly" } ],
+	"NetworkPolicy" : [
+		{ "Name":"RedisDefault", "Rules": ["permit tcp/6379,6380"] },
+		{ "Name":"RedisReadOnly", "Rules": ["permit tcp/6380"] },
+		{ "Name":"RedisAdmin", "Rules": ["permit tcp/6381"] } ]
+	}
+	`)
+	p := newTestProject(t, `
+            web:
+              image: web
+              links:
+               - redis
+              labels:
+                io.contiv.link.redis: "RedisReadOnly"
+            worker:
+              image: worker
+              links:
+               - redis
+            redis:
+              image: redis
+              labels:
+                io.contiv.policy: "RedisDefault"
+            `)
+
+	b := NewMemBackend()
+	SetBackend(b)
+	defer SetBackend(nil)
+
+	if err := CreateNetConfig(p, testPrincipal); err != nil {
+		t.Fatalf("Unable to create net config. Error %v", err)
+	}
+
+	ports := make(map[string][]int)
+	rules, _ := b.RuleList()
+	for _, rule := range *rules {
+		if rule.PolicyName == "example_redis-in" && rule.Action == "allow" {
+			ports[rule.FromEndpointGroup] = append(ports[rule.FromEndpointGroup], rule.Port)
+		}
+	}
+	sort.Ints(ports["example_worker"])
+	if fmt.Sprint(ports["example_web"]) != "[6380]" || fmt.Sprint(ports["example_worker"]) != "[6379 6380]" {
+		t.Fatalf("unexpected ports allowed to redis: %v", ports)
+	}
+
+	// the policy of a link takes the permission of any other
+	p = newTestProject(t, `
+            web:
+              image: web
+              links:
+               - redis
+              labels:
+                io.contiv.link.redis: "RedisAdmin"
+            redis:
+              image: redis
+              labels:
+                io.contiv.policy: "RedisDefault"
+            `)
+	SetBackend(NewMemBackend())
+	err := CreateNetConfig(p, testPrincipal)
+	authzErr := &ops.AuthzError{}
+	if !errors.Is(err, ops.ErrPolicyDenied) || !errors.As(err, &authzErr) || authzErr.Name != "RedisAdmin" {
+		t.Fatalf("link policy applied without permission: %v", err)
+	}
+
+	// and may only narrow the policy of the provider
+	loadTestOps(t, `
+	{
+	"UserPolicy" : [
+		{ "User":"$USER", "Networks": "all", "NetworkPolicies": "all" } ],
+	"NetworkPolicy" : [
+		{ "Name":"RedisDefault", "Rules": ["permit tcp/6379,6380"] },
+		{ "Name":"RedisAdmin", "Rules": ["permit tcp/6379,6381"] } ]
+	}
+	`)
+	SetBackend(NewMemBackend())
+	err = CreateNetConfig(p, testPrincipal)
+	if !errors.Is(err, ops.ErrPolicyDenied) || !errors.As(err, &authzErr) ||
+		authzErr.Resource != "link" || authzErr.Name != "web -> redis" {
+		t.Fatalf("link policy wider than the policy of the provider applied: %v", err)
+	}
+}
+
+func TestExpandRules(t *testing.T) {
+	newRule := func(action string, index int, proto, port string) ops.Rule {
+		natPort, err := nat.NewPort(proto, port)
+		if err != nil {
+			t.Fatalf("Unable to create port %s/%s: %s", proto, port, err)
+		}
+		return ops.Rule{Action: action, Index: index, Port: natPort}
+	}
+
+	portRules := expandRules([]ops.Rule{
+		newRule("deny", 0, "tcp", "21"),
+		newRule("permit", 1, "tcp", "20-22"),
+		newRule("permit", 1, "tcp", "22"),
+		newRule("permit", 2, "udp", "1-65535"),
+		newRule("deny", 3, "udp", "53"),
+	})
+
+	expRules := []portRule{
+		{action: "deny", proto: "tcp", port: 21, index: 0},
+		{action: "permit", proto: "tcp", port: 20, index: 1},
+		{action: "permit", proto: "tcp", port: 22, index: 1},
+		{action: "permit", proto: "udp", port: 0, index: 2},
+	}
+	if len(portRules) != len(expRules) {
+		t.Fatalf("got rules %#v, expected %#v", portRules, expRules)
+	}
+	for idx := range expRules {
+		if portRules[idx] != expRules[idx] {
+			t.Fatalf("got rules %#v, expected %#v", portRules, expRules)
+		}
+	}
+
+	// wide ranges are expanded port by port
+	portRules = expandRules([]ops.Rule{newRule("permit", 0, "udp", "10000-20000")})
+	if len(portRules) != 10001 || portRules[0].port != 10000 || portRules[10000].port != 20000 {
+		t.Fatalf("range 10000-20000 expanded to %d rules", len(portRules))
+	}
+
+	// port 0 bounds a range like any other port, it does not stand for all
+	portRules = expandRules([]ops.Rule{newRule("permit", 0, "tcp", "0-2")})
+	if len(portRules) != 2 || portRules[0].port != 1 || portRules[1].port != 2 {
+		t.Fatalf("range from port 0 expanded to %#v", portRules)
+	}
+}
+
+func TestEgressRules(t *testing.T) {
+	loadTestOps(t, `
+	{
+	"UserPolicy" : [
+		{ "User":"$USER", "Networks": "all", "NetworkPolicies": "all",
+		  "DefaultNetworkPolicy": "WebOut" } ],
+	"NetworkPolicy" : [
+		{ "Name":"WebOut", "Rules": ["permit all"], "Egress": ["permit tcp/443"] },
+		{ "Name":"RedisIsolated", "Rules": ["permit tcp/6379"], "Egress": [] } ]
+	}
+	`)
+	p := newTestProject(t, `
+            web:
+              image: web
+              links:
+               - redis
+            redis:
+              image: redis
+              labels:
+                io.contiv.policy: "RedisIsolated"
+            `)
+
+	b := NewMemBackend()
+	SetBackend(b)
+	defer SetBackend(nil)
+
+	if err := CreateNetConfig(p, testPrincipal); err != nil {
+		t.Fatalf("Unable to create net config. Error %v", err)
+	}
+
+	epg, _ := b.EndpointGroupGet("default", "dev", "example_web")
+	if !sameStrings(epg.Policies, []string{"example_web-out"}) {
+		t.Fatalf("web epg has unexpected policies %v", epg.Policies)
+	}
+	epg, _ = b.EndpointGroupGet("default", "dev", "example_redis")
+	if !sameStrings(epg.Policies, []string{"example_redis-in", "example_redis-out"}) {
+		t.Fatalf("redis epg has unexpected policies %v", epg.Policies)
+	}
+
+	outRules := map[string][]*contivClient.Rule{}
+	rules, _ := b.RuleList()
+	for _, rule := range *rules {
+		if rule.Direction == "out" {
+			outRules[rule.PolicyName] = append(outRules[rule.PolicyName], rule)
+		}
+	}
+
+	webRules := outRules["example_web-out"]
+	if len(webRules) != 2 {
+		t.Fatalf("unexpected web egress rules %#v", webRules)
+	}
+	for _, rule := range webRules {
+		if rule.Action == "allow" && (rule.Port != 443 || rule.Priority <= 1) {
+			t.Fatalf("unexpected web egress allow rule %#v", rule)
+		}
+	}
+
+	redisRules := outRules["example_redis-out"]
+	if len(redisRules) != 1 || redisRules[0].Action != "deny" {
+		t.Fatalf("redis egress not denied %#v", redisRules)
+	}
+
+	if err := DeleteNetConfig(p, testPrincipal); err != nil {
+		t.Fatalf("Unable to delete net config. Error %v", err)
+	}
+	policies, _ := b.PolicyList()
+	if len(*policies) != 0 {
+		t.Fatalf("policies left behind after delete: %v", *policies)
+	}
+}
+
+func TestExposeFrom(t *testing.T) {
+	loadTestOps(t, `
+	{
+	"UserPolicy" : [
+		{ "User":"$USER", "Networks": "all", "NetworkPolicies": "all",
+		  "DefaultNetworkPolicy": "Web" } ],
+	"NetworkPolicy" : [
+		{ "Name":"Web", "Rules": ["permit tcp/80"], "ExposeFrom": ["10.1.0.0/16"] } ]
+	}
+	`)
+	p := newTestProject(t, `
+            web:
+              image: web
+              ports:
+               - "8080:80"
+            lb:
+              image: lb
+              ports:
+               - "443:443"
+              labels:
+                io.contiv.expose.from: "192.168.0.0/24, 172.16.0.0/12"
+            `)
+
+	b := NewMemBackend()
+	SetBackend(b)
+	defer SetBackend(nil)
+
+	if err := CreateNetConfig(p, testPrincipal); err != nil {
+		t.Fatalf("Unable to create net config. Error %v", err)
+	}
+
+	sources := map[string][]string{}
+	rules, _ := b.RuleList()
+	for _, rule := range *rules {
+		if rule.FromNetwork != "" {
+			t.Fatalf("rule %#v restricted to both network and address", rule)
+		}
+		sources[rule.PolicyName] = append(sources[rule.PolicyName], rule.FromIpAddress)
+	}
+	if !sameStrings(sources["example_web-in"], []string{"10.1.0.0/16"}) {
+		t.Fatalf("web exposed to unexpected sources %v", sources["example_web-in"])
+	}
+	if !sameStrings(sources["example_lb-in"], []string{"192.168.0.0/24", "172.16.0.0/12"}) {
+		t.Fatalf("lb exposed to unexpected sources %v", sources["example_lb-in"])
+	}
+
+	p = newTestProject(t, `
+            web:
+              image: web
+              ports:
+               - "8080:80"
+              labels:
+                io.contiv.expose.from: "office"
+            `)
+	if err := CreateNetConfig(p, testPrincipal); !errors.Is(err, ops.ErrInvalidCIDR) {
+		t.Fatalf("Successfully exposed ports to an invalid cidr: %v", err)
+	}
+}
+
+func TestPublishedPorts(t *testing.T) {
+	loadTestOps(t, `
+	{
+	"UserPolicy" : [
+		{ "User":"$USER", "Networks": "all", "NetworkPolicies": "all",
+		  "DefaultNetworkPolicy": "AllPriviliges" } ],
+	"NetworkPolicy" : [
+		{ "Name":"AllPriviliges", "Rules": ["permit all"] } ]
+	}
+	`)
+	p := newTestProject(t, `
+            dns:
+              image: dns
+              ports:
+               - "8000-8002:8000-8002"
+               - "5353:53/udp"
+            `)
+
+	b := NewMemBackend()
+	SetBackend(b)
+	defer SetBackend(nil)
+
+	if err := CreateNetConfig(p, testPrincipal); err != nil {
+		t.Fatalf("Unable to create net config. Error %v", err)
+	}
+	exposed := []string{}
+	rules, _ := b.RuleList()
+	for _, rule := range *rules {
+		if rule.Priority == RULE_PRIORITY_EXPOSE {
+			exposed = append(exposed, fmt.Sprintf("%s/%d", rule.Protocol, rule.Port))
+		}
+	}
+	if !sameStrings(exposed, []string{"tcp/8000", "tcp/8001", "tcp/8002", "udp/53"}) {
+		t.Fatalf("published ports exposed as %v", exposed)
+	}
+
+	for _, port := range []string{"10000-30000:10000-30000", "0-10:0-10", "80:http", "80/sctp"} {
+		p = newTestProject(t, fmt.Sprintf(`
+            dns:
+              image: dns
+              ports:
+               - "%s"
+            `, port))
+		if err := CreateNetConfig(p, testPrincipal); !errors.Is(err, ErrInvalidPort) {
+			t.Fatalf("Successfully published port '%s': %v", port, err)
+		}
+	}
+}
+
+func TestRuleIDs(t *testing.T) {
+	loadTestOps(t, `
+	{
+	"UserPolicy" : [
+		{ "User":"$USER", "Networks": "all", "NetworkPolicies": "all" } ],
+	"NetworkPolicy" : [
+		{ "Name":"Many", "Rules": ["permit tcp/7000-7011"] } ]
+	}
+	`)
+	compose := `
+            web:
+              image: web
+              links:
+               - db
+            db:
+              image: db
+              ports:
+               - "8080:80"
+              labels:
+                io.contiv.policy: "Many"
+            `
+
+	getIDs := func() map[string]bool {
+		b := NewMemBackend()
+		SetBackend(b)
+		defer SetBackend(nil)
+
+		if err := CreateNetConfig(newTestProject(t, compose), testPrincipal); err != nil {
+			t.Fatalf("Unable to create net config. Error %v", err)
+		}
+		ids := map[string]bool{}
+		rules, _ := b.RuleList()
+		for _, rule := range *rules {
+			if strings.ContainsAny(rule.RuleID, ":/") || ids[rule.RuleID] {
+				t.Fatalf("bad rule id '%s'", rule.RuleID)
+			}
+			ids[rule.RuleID] = true
+		}
+		return ids
+	}
+
+	ids := getIDs()
+	// deny all, twelve allows and the exposed port
+	if len(ids) != 14 || !ids["in-allow-tcp-7011-from-epg-example_web"] {
+		t.Fatalf("unexpected rule ids %v", ids)
+	}
+	for id := range getIDs() {
+		if !ids[id] {
+			t.Fatalf("rule id '%s' changed between runs", id)
+		}
+	}
+}
+
+func TestRulePriorities(t *testing.T) {
+	loadTestOps(t, `
+	{
+	"UserPolicy" : [
+		{ "User":"$USER", "Networks": "all", "NetworkPolicies": "all" } ],
+	"NetworkPolicy" : [
+		{ "Name":"Db", "Rules": ["deny tcp/22", "permit tcp/any"] } ]
+	}
+	`)
+	p := newTestProject(t, `
+            web:
+              image: web
+              links:
+               - db
+            db:
+              image: db
+              ports:
+               - "2222:22"
+              labels:
+                io.contiv.policy: "Db"
+            `)
+
+	b := NewMemBackend()
+	SetBackend(b)
+	defer SetBackend(nil)
+
+	if err := CreateNetConfig(p, testPrincipal); err != nil {
+		t.Fatalf("Unable to create net config. Error %v", err)
+	}
+
+	expPriorities := map[string]int{
+		"in-deny-tcp":                          RULE_PRIORITY_DENY_ALL,
+		"in-allow-tcp-22-from-net-dev":        RULE_PRIORITY_EXPOSE,
+		"in-deny-tcp-22-from-epg-example_web": RULE_PRIORITY_POLICY_MAX,
+		"in-allow-tcp-from-epg-example_web":   RULE_PRIORITY_POLICY_MAX - 1,
+	}
+	for ruleID, priority := range expPriorities {
+		rule, err := b.RuleGet("default", "example_db-in", ruleID)
+		if err != nil {
+			t.Fatalf("rule '%s' not created: %s", ruleID, err)
+		}
+		if rule.Priority != priority {
+			t.Fatalf("rule '%s' has priority %d, expected %d", ruleID, rule.Priority, priority)
+		}
+	}
+
+	if _, err := getPolicyRulePriority(RULE_PRIORITY_POLICY_MAX - RULE_PRIORITY_POLICY_MIN + 1); err == nil {
+		t.Fatalf("priority given to a rule beyond the policy band")
+	}
+	if priority, err := getPolicyRulePriority(ops.RULE_CLAUSES_MAX - 1); err != nil || priority != RULE_PRIORITY_POLICY_MIN {
+		t.Fatalf("last clause of a policy given priority %d: %v", priority, err)
+	}
+	if priority, err := getOverrideRulePriority(ops.RULE_CLAUSES_MAX - 1); err != nil || priority <= RULE_PRIORITY_POLICY_MAX {
+		t.Fatalf("last clause of labels given priority %d: %v", priority, err)
+	}
+}
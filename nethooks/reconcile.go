@@ -0,0 +1,355 @@
+package nethooks
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	contivClient "github.com/contiv/contivmodel/client"
+	"github.com/docker/libcompose/deploy/identity"
+	"github.com/docker/libcompose/project"
+)
+
+// netState is the set of network objects belonging to a project, keyed the
+// way netmaster keys them
+type netState struct {
+	endpointGroups map[string]*contivClient.EndpointGroup
+	policies       map[string]*contivClient.Policy
+	rules          map[string]*contivClient.Rule
+	appProfiles    map[string]*contivClient.AppProfile
+}
+
+func newNetState() *netState {
+	return &netState{
+		endpointGroups: make(map[string]*contivClient.EndpointGroup),
+		policies:       make(map[string]*contivClient.Policy),
+		rules:          make(map[string]*contivClient.Rule),
+		appProfiles:    make(map[string]*contivClient.AppProfile),
+	}
+}
+
+func epgKey(epg *contivClient.EndpointGroup) string {
+	return memKey(epg.TenantName, epg.NetworkName, epg.GroupName)
+}
+
+func policyKey(policy *contivClient.Policy) string {
+	return memKey(policy.TenantName, policy.PolicyName)
+}
+
+func ruleKey(rule *contivClient.Rule) string {
+	return memKey(rule.TenantName, rule.PolicyName, rule.RuleID)
+}
+
+func appKey(app *contivClient.AppProfile) string {
+	return memKey(app.TenantName, app.NetworkName, app.AppProfileName)
+}
+
+// isProjectObject tells if an epg or policy name was generated for the project
+func isProjectObject(p *project.Project, name string) bool {
+	return strings.HasPrefix(name, p.Name+"_")
+}
+
+// readNetState collects the objects of tenantName owned by the project.
+// Ownership is taken from the project's app profiles, which list every epg
+// created by an earlier run, together with the generated object names for
+// the services currently in the project.
+func readNetState(b PolicyBackend, p *project.Project, tenantName string) (*netState, error) {
+	state := newNetState()
+
+	apps, err := b.AppProfileList()
+	if err != nil {
+		return nil, err
+	}
+	ownedEpgs := make(map[string]bool)
+	for _, app := range *apps {
+		if app.TenantName != tenantName || app.AppProfileName != p.Name {
+			continue
+		}
+		state.appProfiles[appKey(app)] = app
+		for _, epgName := range app.EndpointGroups {
+			ownedEpgs[epgName] = true
+		}
+	}
+	for _, svcName := range p.Configs.Keys() {
+		ownedEpgs[getSvcName(p, svcName)] = true
+	}
+
+	epgs, err := b.EndpointGroupList()
+	if err != nil {
+		return nil, err
+	}
+	ownedPolicies := make(map[string]bool)
+	for epgName := range ownedEpgs {
+		ownedPolicies[epgName+"-in"] = true
+		ownedPolicies[epgName+"-out"] = true
+	}
+	for _, epg := range *epgs {
+		if epg.TenantName != tenantName || !ownedEpgs[epg.GroupName] {
+			continue
+		}
+		state.endpointGroups[epgKey(epg)] = epg
+		for _, policyName := range epg.Policies {
+			if isProjectObject(p, policyName) {
+				ownedPolicies[policyName] = true
+			}
+		}
+	}
+
+	policies, err := b.PolicyList()
+	if err != nil {
+		return nil, err
+	}
+	for _, policy := range *policies {
+		if policy.TenantName != tenantName || !ownedPolicies[policy.PolicyName] {
+			continue
+		}
+		state.policies[policyKey(policy)] = policy
+	}
+
+	rules, err := b.RuleList()
+	if err != nil {
+		return nil, err
+	}
+	for _, rule := range *rules {
+		if rule.TenantName != tenantName || !ownedPolicies[rule.PolicyName] {
+			continue
+		}
+		state.rules[ruleKey(rule)] = rule
+	}
+
+	return state, nil
+}
+
+// getDesiredNetState runs the policy translation for the project against an
+// in-memory backend and returns the resulting objects
+func getDesiredNetState(p *project.Project, principal identity.Principal) (*netState, error) {
+	mem := NewMemBackend()
+	if applyLinksBasedPolicyFlag {
+		if err := withBackend(mem, func() error { return applyLinksBasedPolicy(p, principal) }); err != nil {
+			return nil, err
+		}
+	}
+
+	return readNetState(mem, p, getTenantNameFromProject(p))
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	as := append([]string{}, a...)
+	bs := append([]string{}, b...)
+	sort.Strings(as)
+	sort.Strings(bs)
+	for idx := range as {
+		if as[idx] != bs[idx] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameEpg(a, b *contivClient.EndpointGroup) bool {
+	return a.NetworkName == b.NetworkName && sameStrings(a.Policies, b.Policies)
+}
+
+func sameRule(a, b *contivClient.Rule) bool {
+	return a.Action == b.Action &&
+		a.Direction == b.Direction &&
+		a.FromEndpointGroup == b.FromEndpointGroup &&
+		a.FromIpAddress == b.FromIpAddress &&
+		a.FromNetwork == b.FromNetwork &&
+		a.ToEndpointGroup == b.ToEndpointGroup &&
+		a.ToIpAddress == b.ToIpAddress &&
+		a.ToNetwork == b.ToNetwork &&
+		a.Port == b.Port &&
+		a.Priority == b.Priority &&
+		a.Protocol == b.Protocol
+}
+
+func sameApp(a, b *contivClient.AppProfile) bool {
+	return sameStrings(a.EndpointGroups, b.EndpointGroups)
+}
+
+func sortedStateKeys(m interface{}) []string {
+	keys := []string{}
+	switch objs := m.(type) {
+	case map[string]*contivClient.EndpointGroup:
+		for key := range objs {
+			keys = append(keys, key)
+		}
+	case map[string]*contivClient.Policy:
+		for key := range objs {
+			keys = append(keys, key)
+		}
+	case map[string]*contivClient.Rule:
+		for key := range objs {
+			keys = append(keys, key)
+		}
+	case map[string]*contivClient.AppProfile:
+		for key := range objs {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type reconcileStats struct {
+	created, updated, deleted int
+}
+
+// applyNetState moves the backend from the current to the desired state.
+// Objects are created and updated bottom up (policies, rules, epgs, apps)
+// and stale ones removed top down, so that nothing is ever deleted while
+// still referenced.
+func applyNetState(b PolicyBackend, current, desired *netState) (reconcileStats, error) {
+	stats := reconcileStats{}
+
+	for _, key := range sortedStateKeys(desired.policies) {
+		if _, ok := current.policies[key]; ok {
+			continue
+		}
+		if err := b.PolicyPost(desired.policies[key]); err != nil {
+			log.Errorf("Unable to create policy '%s'. Error %v", key, err)
+			return stats, err
+		}
+		stats.created++
+	}
+
+	for _, key := range sortedStateKeys(desired.rules) {
+		rule := desired.rules[key]
+		if cur, ok := current.rules[key]; ok {
+			if sameRule(cur, rule) {
+				continue
+			}
+			// rules can not be updated in place
+			if err := b.RuleDelete(cur.TenantName, cur.PolicyName, cur.RuleID); err != nil {
+				log.Errorf("Unable to replace rule '%s'. Error %v", key, err)
+				return stats, err
+			}
+			stats.updated++
+		} else {
+			stats.created++
+		}
+		if err := b.RulePost(rule); err != nil {
+			log.Errorf("Unable to create rule '%s'. Error %v", key, err)
+			return stats, err
+		}
+	}
+
+	for _, key := range sortedStateKeys(desired.endpointGroups) {
+		epg := desired.endpointGroups[key]
+		cur, ok := current.endpointGroups[key]
+		if ok && sameEpg(cur, epg) {
+			continue
+		}
+		if err := b.EndpointGroupPost(epg); err != nil {
+			log.Errorf("Unable to post epg '%s'. Error %v", key, err)
+			return stats, err
+		}
+		if ok {
+			stats.updated++
+		} else {
+			stats.created++
+		}
+	}
+
+	for _, key := range sortedStateKeys(desired.appProfiles) {
+		app := desired.appProfiles[key]
+		cur, ok := current.appProfiles[key]
+		if ok && sameApp(cur, app) {
+			continue
+		}
+		if err := b.AppProfilePost(app); err != nil {
+			log.Errorf("Unable to post app '%s'. Error %v", key, err)
+			return stats, err
+		}
+		if ok {
+			stats.updated++
+		} else {
+			stats.created++
+		}
+	}
+
+	for _, key := range sortedStateKeys(current.appProfiles) {
+		if _, ok := desired.appProfiles[key]; ok {
+			continue
+		}
+		app := current.appProfiles[key]
+		if err := b.AppProfileDelete(app.TenantName, app.NetworkName, app.AppProfileName); err != nil {
+			log.Errorf("Unable to delete stale app '%s'. Error %v", key, err)
+			return stats, err
+		}
+		stats.deleted++
+	}
+
+	for _, key := range sortedStateKeys(current.endpointGroups) {
+		if _, ok := desired.endpointGroups[key]; ok {
+			continue
+		}
+		epg := current.endpointGroups[key]
+		if err := b.EndpointGroupDelete(epg.TenantName, epg.NetworkName, epg.GroupName); err != nil {
+			log.Errorf("Unable to delete stale epg '%s'. Error %v", key, err)
+			return stats, err
+		}
+		stats.deleted++
+	}
+
+	for _, key := range sortedStateKeys(current.rules) {
+		if _, ok := desired.rules[key]; ok {
+			continue
+		}
+		rule := current.rules[key]
+		if _, ok := desired.policies[policyKey(&contivClient.Policy{
+			TenantName: rule.TenantName, PolicyName: rule.PolicyName})]; !ok {
+			// goes away with its policy
+			continue
+		}
+		if err := b.RuleDelete(rule.TenantName, rule.PolicyName, rule.RuleID); err != nil {
+			log.Errorf("Unable to delete stale rule '%s'. Error %v", key, err)
+			return stats, err
+		}
+		stats.deleted++
+	}
+
+	for _, key := range sortedStateKeys(current.policies) {
+		if _, ok := desired.policies[key]; ok {
+			continue
+		}
+		policy := current.policies[key]
+		if err := b.PolicyDelete(policy.TenantName, policy.PolicyName); err != nil {
+			log.Errorf("Unable to delete stale policy '%s'. Error %v", key, err)
+			return stats, err
+		}
+		stats.deleted++
+	}
+
+	return stats, nil
+}
+
+// reconcileNetConfig brings the network objects owned by the project in
+// line with the composition, leaving unchanged objects alone
+func reconcileNetConfig(p *project.Project, principal identity.Principal) error {
+	desired, err := getDesiredNetState(p, principal)
+	if err != nil {
+		return err
+	}
+
+	tenantName := getTenantNameFromProject(p)
+	current, err := readNetState(backend, p, tenantName)
+	if err != nil {
+		log.Errorf("Unable to read network state of project '%s'. Error %v", p.Name, err)
+		return fmt.Errorf("%w: %s", ErrBackendUnavailable, err)
+	}
+
+	stats, err := applyNetState(backend, current, desired)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Project '%s': %d network objects created, %d updated, %d deleted",
+		p.Name, stats.created, stats.updated, stats.deleted)
+	return nil
+}
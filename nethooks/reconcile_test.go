@@ -0,0 +1,76 @@
+package nethooks
+
+import (
+	"testing"
+)
+
+func TestReconcileNetConfig(t *testing.T) {
+	loadTestOps(t, testOps)
+
+	b := newRecordingBackend()
+	SetBackend(b)
+	defer SetBackend(nil)
+
+	if err := CreateNetConfig(newTestProject(t, testCompose), testPrincipal); err != nil {
+		t.Fatalf("Unable to create net config. Error %v", err)
+	}
+	if len(b.ops) == 0 {
+		t.Fatalf("nothing created on first run")
+	}
+
+	b.ops = nil
+	if err := CreateNetConfig(newTestProject(t, testCompose), testPrincipal); err != nil {
+		t.Fatalf("Unable to create net config. Error %v", err)
+	}
+	if len(b.ops) != 0 {
+		t.Fatalf("unchanged composition posted objects again: %#v", b.ops)
+	}
+
+	b.ops = nil
+	if err := CreateNetConfig(newTestProject(t, `
+            web:
+              image: web
+              ports:
+               - "5000:5000"
+              links:
+               - redis
+            redis:
+              image: redis
+              labels:
+                io.contiv.policy: "RedisSingle"
+            `), testPrincipal); err != nil {
+		t.Fatalf("Unable to create net config. Error %v", err)
+	}
+	rules, _ := b.RuleList()
+	for _, rule := range *rules {
+		if rule.Port == 6378 {
+			t.Fatalf("stale rule left behind %#v", rule)
+		}
+	}
+	if len(b.ops) != 1 || b.ops[0].Action != "delete" || b.ops[0].Kind != "rule" {
+		t.Fatalf("expected a single rule delete, got %#v", b.ops)
+	}
+
+	b.ops = nil
+	if err := CreateNetConfig(newTestProject(t, `
+            web:
+              image: web
+              ports:
+               - "5000:5000"
+            `), testPrincipal); err != nil {
+		t.Fatalf("Unable to create net config. Error %v", err)
+	}
+	if _, err := b.EndpointGroupGet("default", "dev", "example_redis"); err == nil {
+		t.Fatalf("epg of removed service left behind")
+	}
+	if _, err := b.PolicyGet("default", "example_redis-in"); err == nil {
+		t.Fatalf("policy of removed service left behind")
+	}
+	app, err := b.AppProfileGet("default", "dev", "example")
+	if err != nil || len(app.EndpointGroups) != 1 || app.EndpointGroups[0] != "example_web" {
+		t.Fatalf("app profile not updated: %#v %v", app, err)
+	}
+	if _, err := b.RuleGet("default", "example_web-in", "in-allow-tcp-5000-from-net-dev"); err != nil {
+		t.Fatalf("unchanged expose rule removed: %s", err)
+	}
+}
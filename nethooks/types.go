@@ -1,14 +1,50 @@
 package nethooks
 
+import (
+	"github.com/docker/libcompose/deploy/ops"
+)
+
 const (
 	USER_LABEL   = "io.contiv.user"
 	TENANT_LABEL = "io.contiv.tenant"
 	NETWORK_LABEL = "io.contiv.network"
     NET_ISOLATION_GROUP_LABEL = "io.contiv.group"
 	NET_ISOLATION_POLICY_LABEL = "io.contiv.policy"
+	EXPOSE_FROM_LABEL = "io.contiv.expose.from"
+	// CONTRACT_LABEL_PREFIX followed by the name of a provider labels the
+	// consumer with the rules of its contract with the provider
+	CONTRACT_LABEL_PREFIX = "io.contiv.contract."
+	// LINK_POLICY_LABEL_PREFIX followed by the name of a provider labels the
+	// consumer with the policy of its traffic to the provider
+	LINK_POLICY_LABEL_PREFIX = "io.contiv.link."
 )
 
 const (
 	TENANT_DEFAULT  = "default"
 	NETWORK_DEFAULT = "dev"
 )
+
+// Where the network of a service was taken from
+const (
+	NETWORK_SOURCE_SERVICE = "service"
+	NETWORK_SOURCE_USER    = "user default"
+	NETWORK_SOURCE_OPS     = "ops default"
+	NETWORK_SOURCE_BUILTIN = "builtin default"
+)
+
+// Priorities of the generated rules; netmaster applies the matching rule of
+// highest priority. Rules of an ops.json policy or contract take the policy
+// band in the order they are listed, so that they can deny what is published.
+// Rules a user gives in the labels of a service, io.contiv.contract.* and
+// io.contiv.link.*, take the override band above it. Each band holds
+// ops.RULE_CLAUSES_MAX priorities, one per clause; loading the ops files and
+// parsing the rules of labels refuse policies and contracts with more.
+const (
+	RULE_PRIORITY_DENY_ALL     = 1
+	RULE_PRIORITY_ALLOW_ALL    = 2
+	RULE_PRIORITY_EXPOSE       = 5
+	RULE_PRIORITY_POLICY_MIN   = 10
+	RULE_PRIORITY_POLICY_MAX   = RULE_PRIORITY_POLICY_MIN + ops.RULE_CLAUSES_MAX - 1
+	RULE_PRIORITY_OVERRIDE_MIN = RULE_PRIORITY_POLICY_MAX + 1
+	RULE_PRIORITY_OVERRIDE_MAX = RULE_PRIORITY_OVERRIDE_MIN + ops.RULE_CLAUSES_MAX - 1
+)
@@ -3,8 +3,6 @@ package nethooks
 import (
 	"errors"
 	"os"
-	"os/exec"
-	"strings"
 
 	"github.com/docker/go-connections/nat"
 	log "github.com/Sirupsen/logrus"
@@ -61,16 +59,6 @@ func getImageInfo(imageName string) ([]nat.Port, error) {
 	return imageInfoList, nil
 }
 
-func getSelfId() (string, error) {
-	output, err := exec.Command("/usr/bin/id", "-u", "-n").CombinedOutput()
-	if err != nil {
-		log.Errorf("Unable to fetch the user id. Error %v", err)
-		return "", err
-	}
-	userId := strings.TrimSpace(string(output))
-	return userId, nil
-}
-
 func getDnsInfo(targetNetwork, tenant string) (string, error) {
 	dnsContName := tenant + "dns"
 	if tenant != TENANT_DEFAULT {
@@ -0,0 +1,103 @@
+package ops
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// COMPOSE_POLICY_KEY is the extension block of a compose file holding the
+	// policies local to the project
+	COMPOSE_POLICY_KEY = "x-contiv-policy"
+)
+
+// composePolicy lists the sections a compose file may define; users and
+// their permissions are left to the ops files
+type composePolicy struct {
+	NetworkPolicy []NetworkPolicyInfo
+}
+
+func isYAML(fileName string) bool {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// jsonValue turns a value decoded from YAML into the value encoding/json
+// would have decoded, so that both formats go through the same checks
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		obj := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			obj[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return obj
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = jsonValue(item)
+		}
+		return list
+	}
+	return value
+}
+
+// yamlToJSON converts an ops file written in YAML to JSON
+func yamlToJSON(fileName string, data []byte) ([]byte, error) {
+	var value interface{}
+	if err := yaml.Unmarshal(data, &value); err != nil {
+		log.Errorf("error unmarshaling yaml %#v \n", err)
+		return nil, &OpsError{File: fileName, Problems: []OpsProblem{{File: fileName, Path: "$", Reason: err.Error()}}}
+	}
+	return json.Marshal(jsonValue(value))
+}
+
+// parseComposeFile reads the policies of the x-contiv-policy block of a
+// compose file; nil if the file has none
+func parseComposeFile(fileName string) (*opsPolicy, error) {
+
+	composeBytes, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		log.Errorf("error reading the compose file: %s", err)
+		return nil, err
+	}
+
+	top := make(map[string]interface{})
+	if err := yaml.Unmarshal(composeBytes, &top); err != nil {
+		log.Errorf("error unmarshaling yaml %#v \n", err)
+		return nil, fmt.Errorf("unable to read compose file '%s': %w", fileName, err)
+	}
+	block, ok := top[COMPOSE_POLICY_KEY]
+	if !ok {
+		return nil, nil
+	}
+
+	blockBytes, err := json.Marshal(jsonValue(block))
+	if err != nil {
+		return nil, err
+	}
+	policy, err := parseOpsData(fileName, blockBytes, reflect.TypeOf(composePolicy{}))
+	opsErr := &OpsError{}
+	if errors.As(err, &opsErr) {
+		for i := range opsErr.Problems {
+			opsErr.Problems[i].Path = "$." + COMPOSE_POLICY_KEY + strings.TrimPrefix(opsErr.Problems[i].Path, "$")
+		}
+	}
+	if policy != nil {
+		// sections a compose file may not set are reported, not merged
+		policy = &opsPolicy{NetworkPolicy: policy.NetworkPolicy}
+	}
+
+	return policy, err
+}
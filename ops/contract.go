@@ -0,0 +1,85 @@
+package ops
+
+// ContractInfo sets the rules of the traffic from a Consumer service to a
+// Provider service, in place of the policy of the provider. Services are
+// named as in the compose file; Project limits the contract to one project,
+// and without it the contract holds in every project with services of these
+// names.
+type ContractInfo struct {
+	Project  string
+	Consumer string
+	Provider string
+	Rules    []string
+}
+
+// ContractName names the contract from consumer to provider in messages
+func ContractName(consumer, provider string) string {
+	return consumer + " -> " + provider
+}
+
+// contractKey identifies a contract among those of the ops files
+func contractKey(contract ContractInfo) string {
+	if contract.Project == "" {
+		return ContractName(contract.Consumer, contract.Provider)
+	}
+	return contract.Project + ": " + ContractName(contract.Consumer, contract.Provider)
+}
+
+// getContract returns the index of the contract from consumer to provider in
+// a project, preferring one for the project to one for every project; -1 if
+// there is none
+func (o *opsPolicy) getContract(project, consumer, provider string) int {
+	found := -1
+	for i, contract := range o.Contracts {
+		if contract.Consumer != consumer || contract.Provider != provider {
+			continue
+		}
+		if contract.Project == project && project != "" {
+			return i
+		}
+		if contract.Project == "" {
+			found = i
+		}
+	}
+	return found
+}
+
+// GetContractRules returns the rules of the contract from consumer to
+// provider in a project in the order they are listed; nil if there is no
+// such contract
+func GetContractRules(project, consumer, provider string) ([]Rule, error) {
+	o := current()
+	i := o.getContract(project, consumer, provider)
+	if i == -1 {
+		return nil, nil
+	}
+	return parseRules(ContractName(consumer, provider), o.Contracts[i].Rules)
+}
+
+// ContractOrigin tells where the contract from consumer to provider in a
+// project was read from
+func ContractOrigin(project, consumer, provider string) (Origin, bool) {
+	o := current()
+	i := o.getContract(project, consumer, provider)
+	if i == -1 {
+		return Origin{}, false
+	}
+	return o.contractOrigins[i], true
+}
+
+// GetContractProviders returns the providers consumer holds a contract with
+// in a project
+func GetContractProviders(project, consumer string) []string {
+	providers := []string{}
+	seen := make(map[string]bool)
+	for _, contract := range current().Contracts {
+		if contract.Consumer != consumer || seen[contract.Provider] {
+			continue
+		}
+		if contract.Project == "" || contract.Project == project {
+			seen[contract.Provider] = true
+			providers = append(providers, contract.Provider)
+		}
+	}
+	return providers
+}
@@ -0,0 +1,78 @@
+package ops
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrTenantDenied    = errors.New("Deny disallowed tenant")
+	ErrNetworkDenied   = errors.New("Deny disallowed network")
+	ErrPolicyDenied    = errors.New("Deny disallowed policy")
+	ErrPolicyNotFound  = errors.New("Unrecognized policy")
+	ErrDefaultNotFound = errors.New("Default Not Found")
+	ErrInvalidRule     = errors.New("Invalid rule")
+	ErrInvalidOps      = errors.New("Invalid ops policy")
+	ErrInvalidCIDR     = errors.New("Invalid CIDR")
+)
+
+// AuthzError is returned when a user is not allowed to use a resource; it
+// unwraps to ErrTenantDenied, ErrNetworkDenied or ErrPolicyDenied
+type AuthzError struct {
+	User     string
+	Resource string
+	Name     string
+	Err      error
+}
+
+func (e *AuthzError) Error() string {
+	return fmt.Sprintf("%s: user '%s' not allowed to use %s '%s'", e.Err, e.User, e.Resource, e.Name)
+}
+
+func (e *AuthzError) Unwrap() error {
+	return e.Err
+}
+
+// RuleError is returned for a rule that does not parse; it unwraps to
+// ErrInvalidRule
+type RuleError struct {
+	Policy string
+	Rule   string
+	Reason string
+}
+
+func (e *RuleError) Error() string {
+	return fmt.Sprintf("%s '%s' in policy '%s': %s", ErrInvalidRule, e.Rule, e.Policy, e.Reason)
+}
+
+func (e *RuleError) Unwrap() error {
+	return ErrInvalidRule
+}
+
+// OpsProblem is one problem found in an ops file, located by a JSON path
+// such as $.UserPolicy[1].Networks
+type OpsProblem struct {
+	File   string
+	Path   string
+	Reason string
+}
+
+// OpsError lists every problem found in the ops files loaded together; it
+// unwraps to ErrInvalidOps. File is the file of highest precedence.
+type OpsError struct {
+	File     string
+	Problems []OpsProblem
+}
+
+func (e *OpsError) Error() string {
+	problems := []string{}
+	for _, problem := range e.Problems {
+		problems = append(problems, fmt.Sprintf("'%s' %s: %s", problem.File, problem.Path, problem.Reason))
+	}
+	return fmt.Sprintf("%s: %s", ErrInvalidOps, strings.Join(problems, "; "))
+}
+
+func (e *OpsError) Unwrap() error {
+	return ErrInvalidOps
+}
@@ -0,0 +1,343 @@
+package ops
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+)
+
+// Layers of the ops configuration, from the lowest precedence to the highest
+const (
+	LAYER_SYSTEM  = "system"
+	LAYER_TEAM    = "team"
+	LAYER_USER    = "user"
+	LAYER_PROJECT = "project"
+	// LAYER_COMPOSE holds the policies of the compose files, above all the
+	// ops files; it may only add policies
+	LAYER_COMPOSE = "compose"
+)
+
+// opsFileNames are the names an ops file is looked up by in a directory, in
+// order; the first one found is used
+var opsFileNames = []string{opsFileName, "ops.yaml", "ops.yml"}
+
+// Layer is one ops file of the configuration
+type Layer struct {
+	Name string
+	File string
+}
+
+// Origin tells which layer an effective user, group or policy entry was
+// read from
+type Origin struct {
+	Kind  string
+	Name  string
+	Layer string
+	File  string
+	// Index of the entry in its file
+	Index int
+}
+
+// Trusted tells whether the entry was read from a system or team layer
+func (o Origin) Trusted() bool {
+	return isTrustedLayer(o.Layer)
+}
+
+// findOpsFile returns the ops file of dir, if any
+func findOpsFile(dir string) (string, bool) {
+	for _, name := range opsFileNames {
+		fileName := filepath.Join(dir, name)
+		if _, err := os.Stat(fileName); err == nil {
+			return fileName, true
+		}
+	}
+	return "", false
+}
+
+func systemConfigDirs() []string {
+	configDirs := os.Getenv("XDG_CONFIG_DIRS")
+	if configDirs == "" {
+		configDirs = "/etc/xdg:/etc"
+	}
+
+	dirs := []string{}
+	for _, dir := range filepath.SplitList(configDirs) {
+		if dir != "" {
+			dirs = append(dirs, filepath.Join(dir, "contiv"))
+		}
+	}
+	return dirs
+}
+
+// DefaultLayers lists the existing ops files, from the lowest precedence to
+// the highest:
+//   - system: contiv/ops.json under $XDG_CONFIG_DIRS (/etc/xdg and /etc)
+//   - team: the *.json and *.yaml drop-ins of contiv/ops.d under the same
+//     directories, in name order
+//   - user: contiv/ops.json under $XDG_CONFIG_HOME (~/.config)
+//   - project: the given file, else the one named by CONTIV_OPS_FILE, else
+//     ./ops.json
+//
+// Where ops.json is missing, ops.yaml and then ops.yml are looked for.
+// The first directory of $XDG_CONFIG_DIRS takes precedence over the next
+// ones. A project file named explicitly is listed even if it is missing.
+func DefaultLayers(projectFile string) []Layer {
+	layers := []Layer{}
+	seen := make(map[string]bool)
+	add := func(name, file string, mustExist bool) {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			abs = file
+		}
+		if seen[abs] {
+			return
+		}
+		if _, err := os.Stat(file); err != nil && !mustExist {
+			return
+		}
+		seen[abs] = true
+		layers = append(layers, Layer{Name: name, File: file})
+	}
+
+	dirs := systemConfigDirs()
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if fileName, ok := findOpsFile(dirs[i]); ok {
+			add(LAYER_SYSTEM, fileName, false)
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		dropIns := []string{}
+		for _, pattern := range []string{"*.json", "*.yaml", "*.yml"} {
+			matches, _ := filepath.Glob(filepath.Join(dirs[i], "ops.d", pattern))
+			dropIns = append(dropIns, matches...)
+		}
+		sort.Strings(dropIns)
+		for _, dropIn := range dropIns {
+			add(LAYER_TEAM, dropIn, false)
+		}
+	}
+
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			configHome = filepath.Join(home, ".config")
+		}
+	}
+	if configHome != "" {
+		if fileName, ok := findOpsFile(filepath.Join(configHome, "contiv")); ok {
+			add(LAYER_USER, fileName, false)
+		}
+	}
+
+	switch {
+	case projectFile != "":
+		add(LAYER_PROJECT, projectFile, true)
+	case os.Getenv(OPS_FILE_ENV) != "":
+		add(LAYER_PROJECT, os.Getenv(OPS_FILE_ENV), true)
+	default:
+		if fileName, ok := findOpsFile("."); ok {
+			add(LAYER_PROJECT, fileName, false)
+		}
+	}
+
+	return layers
+}
+
+// isTrustedLayer tells whether a layer is kept by the operators; the user,
+// project and compose layers may only add to what it defines
+func isTrustedLayer(name string) bool {
+	return name == LAYER_SYSTEM || name == LAYER_TEAM
+}
+
+// overrideFields sets the string fields of dst that are set in src
+func overrideFields(dst, src interface{}) {
+	d, v := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src)
+	for i := 0; i < v.NumField(); i++ {
+		if field := v.Field(i); field.Kind() == reflect.String && field.String() != "" {
+			d.Field(i).SetString(field.String())
+		}
+	}
+}
+
+// overrideTrustedFields sets the string fields of the section of dst that
+// are set in src, as overrideFields does, recording those set by a trusted
+// layer; a lower-trust layer setting one of them is a problem, and the
+// field is left as is.
+func (o *opsPolicy) overrideTrustedFields(layer Layer, section string, dst, src interface{}) []OpsProblem {
+	problems := []OpsProblem{}
+	if o.trustedFields == nil {
+		o.trustedFields = make(map[string]Layer)
+	}
+
+	d, v := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Kind() != reflect.String || field.String() == "" {
+			continue
+		}
+		path := section + "." + v.Type().Field(i).Name
+		if isTrustedLayer(layer.Name) {
+			o.trustedFields[path] = layer
+		} else if trusted, ok := o.trustedFields[path]; ok {
+			problems = append(problems, OpsProblem{
+				File:   layer.File,
+				Path:   "$." + path,
+				Reason: fmt.Sprintf("overrides the setting of the %s layer '%s'", trusted.Name, trusted.File),
+			})
+			continue
+		}
+		d.Field(i).SetString(field.String())
+	}
+	return problems
+}
+
+// overridesTrusted returns the problem of an entry of a lower-trust layer
+// replacing the entry of a trusted layer, nil if it does not
+func overridesTrusted(layer Layer, path string, origin Origin) *OpsProblem {
+	if isTrustedLayer(layer.Name) || !isTrustedLayer(origin.Layer) {
+		return nil
+	}
+	return &OpsProblem{
+		File:   layer.File,
+		Path:   path,
+		Reason: fmt.Sprintf("overrides the %s '%s' of the %s layer '%s'", origin.Kind, origin.Name, origin.Layer, origin.File),
+	}
+}
+
+// merge lays the entries of a file over those merged so far: sections are
+// overridden field by field, and an entry for the same user, group, policy
+// name or contract replaces the one of a lower layer as a whole. Entries listed
+// twice in one file are kept, to be reported, and compose files may not
+// replace the policies of the ops files. The user and project layers may add
+// policies and override the label map, but not replace the policy and
+// contract entries nor the Netmaster and Identity settings of the system and
+// team layers. Once a system or team layer is merged, users and
+// groups are granted by those layers only, as an entry for a user overrides
+// those of its groups.
+func (o *opsPolicy) merge(layer Layer, policy *opsPolicy) []OpsProblem {
+	problems := []OpsProblem{}
+
+	if isTrustedLayer(layer.Name) && o.trustedLayer.File == "" {
+		o.trustedLayer = layer
+	}
+
+	if policy.Version > o.Version {
+		o.Version = policy.Version
+	}
+	if policy.DefaultNetwork != "" {
+		o.DefaultNetwork = policy.DefaultNetwork
+	}
+	overrideFields(&o.LabelMap, policy.LabelMap)
+	problems = append(problems, o.overrideTrustedFields(layer, "Netmaster", &o.Netmaster, policy.Netmaster)...)
+	problems = append(problems, o.overrideTrustedFields(layer, "Identity", &o.Identity, policy.Identity)...)
+
+	for i, entry := range policy.UserPolicy {
+		origin := Origin{Kind: "user", Name: entry.User, Layer: layer.Name, File: layer.File, Index: i}
+		if entry.Group != "" {
+			origin.Kind, origin.Name = "group", entry.Group
+		}
+		if !isTrustedLayer(layer.Name) && o.trustedLayer.File != "" {
+			problems = append(problems, OpsProblem{
+				File:   layer.File,
+				Path:   fmt.Sprintf("$.UserPolicy[%d]", i),
+				Reason: fmt.Sprintf("%s '%s' not granted by the %s layer '%s'", origin.Kind, origin.Name, o.trustedLayer.Name, o.trustedLayer.File),
+			})
+			continue
+		}
+		replaced := false
+		for j, other := range o.UserPolicy {
+			if other.User == entry.User && other.Group == entry.Group && o.userOrigins[j].File != layer.File {
+				o.UserPolicy[j], o.userOrigins[j] = entry, origin
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			o.UserPolicy = append(o.UserPolicy, entry)
+			o.userOrigins = append(o.userOrigins, origin)
+		}
+	}
+
+	for i, entry := range policy.NetworkPolicy {
+		origin := Origin{Kind: "policy", Name: entry.Name, Layer: layer.Name, File: layer.File, Index: i}
+		replaced := false
+		for j, other := range o.NetworkPolicy {
+			if other.Name != entry.Name || o.policyOrigins[j].File == layer.File {
+				continue
+			}
+			if layer.Name == LAYER_COMPOSE && o.policyOrigins[j].Layer != LAYER_COMPOSE {
+				problems = append(problems, OpsProblem{
+					File:   layer.File,
+					Path:   fmt.Sprintf("$.%s.NetworkPolicy[%d].Name", COMPOSE_POLICY_KEY, i),
+					Reason: fmt.Sprintf("policy '%s' already defined in '%s'", entry.Name, o.policyOrigins[j].File),
+				})
+			} else if problem := overridesTrusted(layer, fmt.Sprintf("$.NetworkPolicy[%d].Name", i), o.policyOrigins[j]); problem != nil {
+				problems = append(problems, *problem)
+			} else {
+				o.NetworkPolicy[j], o.policyOrigins[j] = entry, origin
+			}
+			replaced = true
+			break
+		}
+		if !replaced {
+			o.NetworkPolicy = append(o.NetworkPolicy, entry)
+			o.policyOrigins = append(o.policyOrigins, origin)
+		}
+	}
+
+	for i, entry := range policy.Contracts {
+		name := contractKey(entry)
+		origin := Origin{Kind: "contract", Name: name, Layer: layer.Name, File: layer.File, Index: i}
+		replaced := false
+		for j, other := range o.Contracts {
+			if other.Consumer != entry.Consumer || other.Provider != entry.Provider || o.contractOrigins[j].File == layer.File {
+				continue
+			}
+			// a contract for a project takes precedence over one for all
+			if contractKey(other) != name && other.Project != "" {
+				continue
+			}
+			if problem := overridesTrusted(layer, fmt.Sprintf("$.Contracts[%d]", i), o.contractOrigins[j]); problem != nil {
+				problems = append(problems, *problem)
+				replaced = true
+				break
+			}
+			if contractKey(other) == name {
+				o.Contracts[j], o.contractOrigins[j] = entry, origin
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			o.Contracts = append(o.Contracts, entry)
+			o.contractOrigins = append(o.contractOrigins, origin)
+		}
+	}
+
+	return problems
+}
+
+func (o *opsPolicy) origins() []Origin {
+	origins := append([]Origin{}, o.userOrigins...)
+	origins = append(origins, o.policyOrigins...)
+	return append(origins, o.contractOrigins...)
+}
+
+// Origins lists where each effective user, group, policy and contract entry
+// was read from
+func Origins() []Origin {
+	return current().origins()
+}
+
+// PolicyOrigin tells where the effective definition of a policy was read from
+func PolicyOrigin(policyName string) (Origin, bool) {
+	o := current()
+	for i, policy := range o.NetworkPolicy {
+		if policy.Name == policyName {
+			return o.policyOrigins[i], true
+		}
+	}
+	return Origin{}, false
+}
@@ -0,0 +1,56 @@
+package ops
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// StringList is a list of names in ops.json, given either as a JSON array or
+// in the legacy comma separated form; blanks around the names are dropped
+type StringList []string
+
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	items := []string{}
+	if err := json.Unmarshal(data, &items); err != nil {
+		value := ""
+		if err := json.Unmarshal(data, &value); err != nil {
+			return err
+		}
+		items = strings.Split(value, ",")
+	}
+
+	list := StringList{}
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	*l = list
+	return nil
+}
+
+func (l StringList) String() string {
+	return strings.Join(l, ",")
+}
+
+// allows tells whether the list names the item, or is "all"
+func (l StringList) allows(item string) bool {
+	for _, listItem := range l {
+		if listItem == item || listItem == "all" {
+			return true
+		}
+	}
+	return false
+}
+
+// duplicate returns a name listed more than once, if any
+func (l StringList) duplicate() (string, bool) {
+	seen := make(map[string]bool)
+	for _, item := range l {
+		if seen[item] {
+			return item, true
+		}
+		seen[item] = true
+	}
+	return "", false
+}
@@ -3,26 +3,34 @@ package ops
 
 import (
 	"encoding/json"
-	"errors"
+	"fmt"
 	"io/ioutil"
-	"strconv"
+	"net"
+	"reflect"
 	"strings"
 	"github.com/docker/go-connections/nat"
 	log "github.com/Sirupsen/logrus"
 )
 
+// UserPolicyInfo grants tenants, networks and policies to a User, or to all
+// members of a Group; fields set on entries of the user override those of
+// its groups. Without Tenants a user is held to its DefaultTenant.
 type UserPolicyInfo struct {
 	User string
+	Group string
+	Tenants StringList
 	DefaultTenant string
-	Networks string
+	Networks StringList
 	DefaultNetwork string
-	NetworkPolicies string
+	NetworkPolicies StringList
 	DefaultNetworkPolicy string
 }
 
 type NetworkPolicyInfo struct {
 	Name string
 	Rules []string
+	Egress []string
+	ExposeFrom []string
 }
 
 type LabelMapInfo struct {
@@ -30,204 +38,458 @@ type LabelMapInfo struct {
 	NetworkIsolationPolicy string
 }
 
+type NetmasterInfo struct {
+	URL string
+	CACert string
+	ClientCert string
+	ClientKey string
+	Token string
+	Timeout string
+}
+
+type IdentityInfo struct {
+	Provider string
+	UserEnv string
+	TokenFile string
+	TokenKeyFile string
+	CertFile string
+	CAFile string
+}
+
 type opsPolicy struct {
+	// Version of the ops.json schema, 0 for files written before it was
+	// introduced
+	Version int
+	DefaultNetwork string
 	LabelMap LabelMapInfo
+	Netmaster NetmasterInfo
+	Identity IdentityInfo
 	UserPolicy []UserPolicyInfo
 	NetworkPolicy []NetworkPolicyInfo
+	Contracts []ContractInfo
+
+	// where each entry of UserPolicy, NetworkPolicy and Contracts was read from
+	userOrigins []Origin
+	policyOrigins []Origin
+	contractOrigins []Origin
+	// Netmaster and Identity fields set by the system and team layers, with
+	// the layer setting them
+	trustedFields map[string]Layer
+	// first system or team layer merged, if any
+	trustedLayer Layer
 }
 
-var ops opsPolicy
+// tenantDefault is the tenant of users without Tenants or DefaultTenant
+const tenantDefault = "default"
+
+// opsVersion is the latest ops.json schema understood
+const opsVersion = 1
+
+// PORT_RANGE_MAX is the widest port range a rule may give, every port of a
+// range becoming a rule in netmaster, which has no port ranges; 1-65535 is
+// taken as any port instead
+const PORT_RANGE_MAX = 16384
+
+// RULE_CLAUSES_MAX is the most clauses a policy or contract may list; each
+// clause takes its own priority in netmaster, out of a band of this size
+const RULE_CLAUSES_MAX = 45
 
+// LoadOps loads the ops policies from the default layers
 func LoadOps() error {
-	opsFile := "./ops.json"
-	return loadOpsWithFile(opsFile)
+	return loadOpsWithFile("")
 }
 
-func loadOpsWithFile(fileName string) error {
+// LoadOpsFile loads the ops policies of the default layers, with the given
+// file as the project layer if the name is not empty, and the policies
+// defined in the compose files of the project
+func LoadOpsFile(fileName string, composeFiles ...string) error {
+	return loadOpsWithFile(fileName, composeFiles...)
+}
+
+func loadOpsWithFile(fileName string, composeFiles ...string) error {
+	s := NewStore(fileName, composeFiles...)
+	if err := s.Load(); err != nil {
+		return err
+	}
+	UseStore(s)
+	return nil
+}
+
+// parseOpsFile reads one ops file, in JSON or, if named *.yaml or *.yml, in
+// YAML; problems found in it are returned as an *OpsError, with as much of
+// the file as could be read
+func parseOpsFile(fileName string) (*opsPolicy, error) {
 
 	composeBytes, err := ioutil.ReadFile(fileName)
 	if err != nil {
-		log.Fatalf("error reading the config file: %s", err)
+		log.Errorf("error reading the config file: %s", err)
+		return nil, err
 	}
+	if isYAML(fileName) {
+		if composeBytes, err = yamlToJSON(fileName, composeBytes); err != nil {
+			return nil, err
+		}
+	}
+
+	return parseOpsData(fileName, composeBytes, reflect.TypeOf(opsPolicy{}))
+}
+
+// parseOpsData decodes the policies of a file, accepting only the fields of
+// schema
+func parseOpsData(fileName string, composeBytes []byte, schema reflect.Type) (*opsPolicy, error) {
 
-	ops = opsPolicy{}
-	if err := json.Unmarshal(composeBytes, &ops); err != nil {
+	policy := &opsPolicy{}
+	if err := json.Unmarshal(composeBytes, policy); err != nil {
 		log.Errorf("error unmarshaling json %#v \n", err)
-		return err
+		return nil, &OpsError{File: fileName, Problems: []OpsProblem{
+			{File: fileName, Path: jsonErrorPath(err), Reason: err.Error()}}}
 	}
 
-	for _, policy := range ops.UserPolicy {
-		if policy.DefaultNetwork == "" {
-			continue
-		}
-		if err := UserOpsCheckNetwork(policy.User, policy.DefaultNetwork); err != nil {
-			log.Errorf("Default network '%s' not present allowed networks '%s'",
-				policy.DefaultNetwork, policy.Networks)
-			return err
-		}
+	var raw interface{}
+	if err := json.Unmarshal(composeBytes, &raw); err != nil {
+		return nil, &OpsError{File: fileName, Problems: []OpsProblem{{File: fileName, Path: "$", Reason: err.Error()}}}
 	}
-
-	for _, policy := range ops.UserPolicy {
-		if policy.DefaultNetworkPolicy == "" {
-			continue
-		}
-		if err := UserOpsCheckNetworkPolicy(policy.User, policy.DefaultNetworkPolicy); err != nil {
-			log.Errorf("Default policy not present in the allowed policies")
-			return err
-		}
+	problems := checkFields("$", raw, schema)
+	for i := range problems {
+		problems[i].File = fileName
+	}
+	problems = append(problems, policy.checkLayer(fileName)...)
+	if len(problems) != 0 {
+		return policy, &OpsError{File: fileName, Problems: problems}
 	}
 
-	return nil
+	return policy, nil
 }
 
 func LabelOpsGetTenant() string {
-	return ops.LabelMap.Tenant
+	return current().LabelMap.Tenant
 }
 
 func LabelOpsGetNetworkIsolationPolicy() string {
-	return ops.LabelMap.NetworkIsolationPolicy
+	return current().LabelMap.NetworkIsolationPolicy
 }
 
-func UserOpsCheckNetwork(userName, network string) error {
-	for _, policy := range ops.UserPolicy {
-		if policy.User != userName {
-			continue
-		}
-		allowedNetworks := strings.Split(policy.Networks, ",")
-		for _, allowedNetwork := range allowedNetworks {
-			if allowedNetwork == network || allowedNetwork == "all" {
-				return nil
-			}
-		}
+// DefaultOpsGetNetwork returns the network of services for users without a
+// DefaultNetwork
+func DefaultOpsGetNetwork() string {
+	return current().DefaultNetwork
+}
+
+func NetmasterOpsGet() NetmasterInfo {
+	return current().Netmaster
+}
+
+func IdentityOpsGet() IdentityInfo {
+	return current().Identity
+}
+
+func entryName(policy UserPolicyInfo) string {
+	if policy.Group != "" {
+		return fmt.Sprintf("group '%s'", policy.Group)
 	}
+	return fmt.Sprintf("user '%s'", policy.User)
+}
 
-	return errors.New("Deny disallowed network")
+func entryGroups(policy UserPolicyInfo) []string {
+	if policy.Group == "" {
+		return nil
+	}
+	return []string{policy.Group}
 }
 
-func UserOpsGetDefaultNetworkPolicy(userName string) (string, error) {
-	for _, policy := range ops.UserPolicy {
-		if policy.User != userName {
-			continue
-		}
-		if policy.DefaultNetworkPolicy != "" {
-			return policy.DefaultNetworkPolicy, nil
+func isMember(groups []string, group string) bool {
+	for _, g := range groups {
+		if g == group {
+			return true
 		}
 	}
+	return false
+}
 
-	return "", errors.New("Default Policy Not Found")
+// mergeUserPolicy adds the networks and policies of src to dst; defaults
+// already set in dst are kept
+func mergeUserPolicy(dst *UserPolicyInfo, src UserPolicyInfo) {
+	dst.Tenants = append(dst.Tenants, src.Tenants...)
+	dst.Networks = append(dst.Networks, src.Networks...)
+	dst.NetworkPolicies = append(dst.NetworkPolicies, src.NetworkPolicies...)
+	if dst.DefaultTenant == "" {
+		dst.DefaultTenant = src.DefaultTenant
+	}
+	if dst.DefaultNetwork == "" {
+		dst.DefaultNetwork = src.DefaultNetwork
+	}
+	if dst.DefaultNetworkPolicy == "" {
+		dst.DefaultNetworkPolicy = src.DefaultNetworkPolicy
+	}
 }
 
-func UserOpsGetDefaultNetwork(userName string) (string, error) {
-	for _, policy := range ops.UserPolicy {
-		if policy.User != userName {
-			continue
-		}
-		if policy.DefaultNetwork != "" {
-			return policy.DefaultNetwork, nil
+// getUserPolicy returns the permission set of a user: the entries of all
+// its groups merged, with each field set by the user's own entries taking
+// their place
+func (o *opsPolicy) getUserPolicy(userName string, groups []string) UserPolicyInfo {
+	userPolicy := UserPolicyInfo{User: userName}
+	groupPolicy := UserPolicyInfo{}
+
+	for _, policy := range o.UserPolicy {
+		if policy.User != "" && policy.User == userName {
+			mergeUserPolicy(&userPolicy, policy)
+		} else if policy.User == "" && policy.Group != "" && isMember(groups, policy.Group) {
+			mergeUserPolicy(&groupPolicy, policy)
 		}
 	}
 
-	return "", errors.New("Default Network Not Found")
+	if len(userPolicy.Tenants) == 0 {
+		userPolicy.Tenants = groupPolicy.Tenants
+	}
+	if len(userPolicy.Networks) == 0 {
+		userPolicy.Networks = groupPolicy.Networks
+	}
+	if len(userPolicy.NetworkPolicies) == 0 {
+		userPolicy.NetworkPolicies = groupPolicy.NetworkPolicies
+	}
+	mergeUserPolicy(&userPolicy, UserPolicyInfo{
+		DefaultTenant:        groupPolicy.DefaultTenant,
+		DefaultNetwork:       groupPolicy.DefaultNetwork,
+		DefaultNetworkPolicy: groupPolicy.DefaultNetworkPolicy,
+	})
+
+	return userPolicy
 }
 
-func UserOpsGetDefaultTenant(userName string) (string, error) {
-	for _, policy := range ops.UserPolicy {
-		if policy.User != userName {
+// allowsTenant tells whether the tenant is listed in Tenants, or is the
+// default tenant when there are none
+func (policy UserPolicyInfo) allowsTenant(tenant string) bool {
+	if len(policy.Tenants) != 0 {
+		return policy.Tenants.allows(tenant)
+	}
+	if policy.DefaultTenant != "" {
+		return tenant == policy.DefaultTenant
+	}
+	return tenant == tenantDefault
+}
+
+func UserOpsCheckTenant(userName, tenant string, groups ...string) error {
+	if current().getUserPolicy(userName, groups).allowsTenant(tenant) {
+		return nil
+	}
+
+	return &AuthzError{User: userName, Resource: "tenant", Name: tenant, Err: ErrTenantDenied}
+}
+
+func UserOpsCheckNetwork(userName, network string, groups ...string) error {
+	policy := current().getUserPolicy(userName, groups)
+	if policy.Networks.allows(network) {
+		return nil
+	}
+
+	return &AuthzError{User: userName, Resource: "network", Name: network, Err: ErrNetworkDenied}
+}
+
+func UserOpsGetDefaultNetworkPolicy(userName string, groups ...string) (string, error) {
+	if policy := current().getUserPolicy(userName, groups); policy.DefaultNetworkPolicy != "" {
+		return policy.DefaultNetworkPolicy, nil
+	}
+
+	return "", fmt.Errorf("%w: no default policy for user '%s'", ErrDefaultNotFound, userName)
+}
+
+func UserOpsGetDefaultNetwork(userName string, groups ...string) (string, error) {
+	if policy := current().getUserPolicy(userName, groups); policy.DefaultNetwork != "" {
+		return policy.DefaultNetwork, nil
+	}
+
+	return "", fmt.Errorf("%w: no default network for user '%s'", ErrDefaultNotFound, userName)
+}
+
+func UserOpsGetDefaultTenant(userName string, groups ...string) (string, error) {
+	if policy := current().getUserPolicy(userName, groups); policy.DefaultTenant != "" {
+		return policy.DefaultTenant, nil
+	}
+
+	return "", fmt.Errorf("%w: no default tenant for user '%s'", ErrDefaultNotFound, userName)
+}
+
+func UserOpsCheckNetworkPolicy(userName, networkPolicy string, groups ...string) error {
+	policy := current().getUserPolicy(userName, groups)
+	if policy.NetworkPolicies.allows(networkPolicy) {
+		return nil
+	}
+
+	return &AuthzError{User: userName, Resource: "policy", Name: networkPolicy, Err: ErrPolicyDenied}
+}
+
+// Rule is a parsed NetworkPolicy rule. Action is "permit" or "deny"; the
+// port may be a range, and a port of 0 stands for any port of the protocol.
+// A clause listing several ports yields one Rule per port, all with the
+// Index of the clause in the policy.
+type Rule struct {
+	Action string
+	Index  int
+	nat.Port
+}
+
+// GetRules returns the rules of a policy in the order they are listed, the
+// first matching rule taking effect
+func GetRules(policyName string) ([]Rule, error) {
+	ruleList := []Rule{}
+
+	for _, policy := range current().NetworkPolicy {
+		if policy.Name != policyName {
 			continue
 		}
-		if policy.DefaultTenant != "" {
-			return policy.DefaultTenant, nil
+		rules, err := parseRules(policyName, policy.Rules)
+		if err != nil {
+			return ruleList, err
 		}
+		ruleList = append(ruleList, rules...)
+	}
+
+	if len(ruleList) == 0 {
+		return ruleList, fmt.Errorf("%w: '%s'", ErrPolicyNotFound, policyName)
 	}
 
-	return "", errors.New("Default Tenant Not Found")
+	return ruleList, nil
 }
 
-func UserOpsCheckNetworkPolicy(userName, networkPolicy string) error {
-	for _, policy := range ops.UserPolicy {
-		if policy.User != userName {
+// GetExposeFrom returns the CIDRs the published ports of services using
+// the policy are restricted to
+func GetExposeFrom(policyName string) ([]string, error) {
+	cidrs := []string{}
+	for _, policy := range current().NetworkPolicy {
+		if policy.Name != policyName {
 			continue
 		}
-		allowedPolicies := strings.Split(policy.NetworkPolicies, ",")
-		for _, allowedPolicy := range allowedPolicies {
-			if allowedPolicy == networkPolicy || allowedPolicy == "all" {
-				return nil
+		for _, cidr := range policy.ExposeFrom {
+			cidr, err := ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
 			}
+			cidrs = append(cidrs, cidr)
 		}
 	}
+	return cidrs, nil
+}
+
+// ParseRules parses rules written as in the policies of ops.json; name
+// identifies them in errors
+func ParseRules(name string, rules []string) ([]Rule, error) {
+	return parseRules(name, rules)
+}
 
-	return errors.New("Deny disallowed policy")
+// ParseCIDR validates an address range such as 10.1.0.0/16 and returns it
+// in canonical form
+func ParseCIDR(cidr string) (string, error) {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", fmt.Errorf("%w: '%s'", ErrInvalidCIDR, cidr)
+	}
+	return ipNet.String(), nil
 }
 
-func GetRules(policyName string) ([]nat.Port, error) {
-	portList := []nat.Port{}
+// GetEgressRules returns the rules restricting traffic out of the services
+// a policy is applied to. A nil list means egress is not restricted.
+func GetEgressRules(policyName string) ([]Rule, error) {
+	var ruleList []Rule
+	found := false
 
-	for _, policy := range ops.NetworkPolicy {
+	for _, policy := range current().NetworkPolicy {
 		if policy.Name != policyName {
 			continue
 		}
-		for _, rule := range policy.Rules {
-			var natPort nat.Port
-			var err error
+		found = true
+		if policy.Egress == nil {
+			continue
+		}
+		rules, err := parseRules(policyName, policy.Egress)
+		if err != nil {
+			return nil, err
+		}
+		if ruleList == nil {
+			ruleList = []Rule{}
+		}
+		ruleList = append(ruleList, rules...)
+	}
 
-			clauses := strings.Split(rule, " ")
-			if len(clauses) <= 0 {
-				return portList, errors.New("none found")
-			}
-			switch clauses[0] {
-				case "permit":
-					if len(clauses) <= 1 {
-						return portList, errors.New("Incomplete permit clause")
-					}
-					protoPort := strings.Split(clauses[1], "/")
-					if len(protoPort) == 0 {
-						return portList, errors.New("Empty proto/port in permit clause")
-					}
-					switch protoPort[0] {
-						case "tcp", "udp":
-							if len(protoPort) <= 1 {
-								return portList, errors.New("Invalid permit clause: port or protocol missing")
-							}
-							pNum, _ := strconv.Atoi(protoPort[1])
-							if pNum < 0 || pNum > 65535 {
-								return portList, errors.New("Invalid port in permit clause")
-							}
-							natPort, err = nat.NewPort(protoPort[0], protoPort[1]);
-							if err != nil {
-								return portList, err
+	if !found {
+		return nil, fmt.Errorf("%w: '%s'", ErrPolicyNotFound, policyName)
+	}
+
+	return ruleList, nil
+}
+
+func parseRules(policyName string, rules []string) ([]Rule, error) {
+	ruleList := []Rule{}
+
+	if len(rules) > RULE_CLAUSES_MAX {
+		return ruleList, &RuleError{Policy: policyName, Rule: rules[RULE_CLAUSES_MAX],
+			Reason: fmt.Sprintf("more than %d clauses in policy", RULE_CLAUSES_MAX)}
+	}
+	for index, rule := range rules {
+		natPorts := []nat.Port{}
+
+		invalid := func(reason string) error {
+			return &RuleError{Policy: policyName, Rule: rule, Reason: reason}
+		}
+
+		clauses := strings.Split(rule, " ")
+		if len(clauses) <= 0 {
+			return ruleList, invalid("none found")
+		}
+		action := clauses[0]
+		switch action {
+			case "permit", "deny":
+				if len(clauses) <= 1 {
+					return ruleList, invalid("Incomplete " + action + " clause")
+				}
+				protoPort := strings.Split(clauses[1], "/")
+				if len(protoPort) == 0 {
+					return ruleList, invalid("Empty proto/port in " + action + " clause")
+				}
+				switch protoPort[0] {
+					case "tcp", "udp":
+						if len(protoPort) <= 1 {
+							return ruleList, invalid("Invalid " + action + " clause: port or protocol missing")
+						}
+						// a comma separated list of ports and port ranges
+						for _, port := range strings.Split(protoPort[1], ",") {
+							if port == "" {
+								return ruleList, invalid("Empty port in " + action + " clause")
 							}
-						case "icmp":
-							natPort, err = nat.NewPort(protoPort[0], "0");
-							if err != nil {
-								return portList, err
+							if port == "any" {
+								port = "0"
 							}
-						case "app":
-							natPort, err = nat.NewPort("app", "0")
+							natPort, err := nat.NewPort(protoPort[0], port)
 							if err != nil {
-								return portList, err
+								return ruleList, invalid("Invalid port in " + action + " clause: " + err.Error())
 							}
-						case "all":
-							natPort, err = nat.NewPort("all", "0")
-							if err != nil {
-								return portList, err
+							if strings.Contains(port, "-") {
+								start, end, _ := natPort.Range()
+								if start == 0 {
+									return ruleList, invalid("Port 0 in range of " + action + " clause")
+								}
+								if end-start+1 > PORT_RANGE_MAX && !(start == 1 && end == 65535) {
+									return ruleList, invalid(fmt.Sprintf("Port range of %s clause wider than %d ports", action, PORT_RANGE_MAX))
+								}
 							}
-						default:
-							return portList, errors.New("Invalid proto in permit clause")
-					}
-
-				case "deny":
-					return portList, errors.New("Not supported")
-
-				default:
-					return portList, errors.New("Invalid clause")
-			}
-			portList = append(portList, natPort)
+							natPorts = append(natPorts, natPort)
+						}
+					case "icmp", "app", "all":
+						natPort, err := nat.NewPort(protoPort[0], "0")
+						if err != nil {
+							return ruleList, err
+						}
+						natPorts = append(natPorts, natPort)
+					default:
+						return ruleList, invalid("Invalid proto in " + action + " clause")
+				}
+
+			default:
+				return ruleList, invalid("Invalid clause")
+		}
+		for _, natPort := range natPorts {
+			ruleList = append(ruleList, Rule{Action: action, Index: index, Port: natPort})
 		}
 	}
 
-	if len(portList) == 0 {
-		return portList, errors.New("Unrecognized policy")
-	}
-
-	return portList, nil
+	return ruleList, nil
 }
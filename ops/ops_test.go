@@ -1,6 +1,9 @@
 package ops
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"testing"
 )
@@ -44,7 +47,7 @@ func TestUserPolicy(t *testing.T) {
 		t.Fatalf("error validating specified network")
 	}
 
-	if err := UserOpsCheckNetwork("vagrant", "public"); err == nil {
+	if err := UserOpsCheckNetwork("vagrant", "public"); !errors.Is(err, ErrNetworkDenied) {
 		t.Fatalf("error validating disallowed network")
 	}
 
@@ -79,7 +82,7 @@ func TestUserPolicy(t *testing.T) {
 		t.Fatalf("error validating allow specific policy privileges")
 	}
 
-	if err := UserOpsCheckNetworkPolicy("vagrant", "app3"); err == nil {
+	if err := UserOpsCheckNetworkPolicy("vagrant", "app3"); !errors.Is(err, ErrPolicyDenied) {
 		t.Fatalf("error validating disallowed policy privileges")
 	}
 
@@ -142,7 +145,7 @@ func TestNetworkPolicy(t *testing.T) {
 	}
 
 	natPorts, err := GetRules("UnknownPolicy")
-	if err == nil {
+	if !errors.Is(err, ErrPolicyNotFound) {
 		t.Fatalf("error validating unknown policy: %s", err)
 	}
 
@@ -154,10 +157,10 @@ func TestNetworkPolicy(t *testing.T) {
 		t.Errorf("natPorts = %#v", natPorts)
 		t.Fatalf("error parsing the rules")
 	}
-	if natPorts[0].Proto() != "tcp" && natPorts[0].Port() != "6379" {
+	if natPorts[0].Proto() != "tcp" && natPorts[0].Port.Port() != "6379" {
 		t.Fatalf("error parsing the port/proto in rules")
 	}
-	if natPorts[1].Proto() != "tcp" && natPorts[1].Port() != "6001" {
+	if natPorts[1].Proto() != "tcp" && natPorts[1].Port.Port() != "6001" {
 		t.Fatalf("error parsing the port/proto in rules")
 	}
 
@@ -169,7 +172,7 @@ func TestNetworkPolicy(t *testing.T) {
 		t.Errorf("natPorts = %#v", natPorts)
 		t.Fatalf("error parsing the rules")
 	}
-	if natPorts[0].Proto() != "tcp" && natPorts[0].Port() != "80" {
+	if natPorts[0].Proto() != "tcp" && natPorts[0].Port.Port() != "80" {
 		t.Fatalf("error parsing the port/proto in rules")
 	}
 	if natPorts[1].Proto() != "icmp" {
@@ -190,39 +193,502 @@ func TestNetworkPolicy(t *testing.T) {
 }
 
 func TestInvalidNetworkPolicy(t *testing.T) {
+	for _, rule := range []string{"permit pp/6379", "permit tcp/666666", "deny tcp"} {
+		writeTmpData(t, []byte(`{ "NetworkPolicy" : [{ "Name":"JunkPolicy", "Rules": ["permit tcp/80", "`+rule+`"] }] }`))
+		err := loadOpsWithFile(tmpFile)
+		opsErr := &OpsError{}
+		if !errors.Is(err, ErrInvalidOps) || !errors.As(err, &opsErr) {
+			t.Fatalf("Successfully loaded invalid rule '%s': %v", rule, err)
+		}
+		if len(opsErr.Problems) != 1 || opsErr.Problems[0].Path != "$.NetworkPolicy[0].Rules[1]" {
+			t.Fatalf("invalid rule '%s' not located: %v", rule, err)
+		}
+		if _, err := parseRules("JunkPolicy", []string{rule}); !errors.Is(err, ErrInvalidRule) {
+			t.Fatalf("Successfully parsed invalid rule '%s'", rule)
+		}
+	}
+}
+
+func TestDenyNetworkPolicy(t *testing.T) {
     jsonData := []byte(`
-			{ "NetworkPolicy" : [{ "Name":"JunkPolicy", "Rules": ["permit pp/6379"] }] }
+			{ "NetworkPolicy" : [{ "Name":"NoSsh", "Rules": ["deny tcp/22", "permit tcp/any", "deny icmp"] }] }
 		`)
 
 	writeTmpData(t, jsonData)
 	if err := loadOpsWithFile(tmpFile); err != nil {
 		t.Fatalf("Error loading ops file: %s", err)
 	}
-	if _, err := GetRules("JunkPolicy"); err == nil {
-		t.Fatalf("Successfully loaded invalid protocol")
+
+	rules, err := GetRules("NoSsh")
+	if err != nil {
+		t.Fatalf("error fetching rules with deny clauses: %s", err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("error parsing the rules %#v", rules)
+	}
+	if rules[0].Action != "deny" || rules[0].Proto() != "tcp" || rules[0].Int() != 22 {
+		t.Fatalf("error parsing deny rule %#v", rules[0])
 	}
+	if rules[1].Action != "permit" || rules[1].Proto() != "tcp" || rules[1].Int() != 0 {
+		t.Fatalf("error parsing permit any rule %#v", rules[1])
+	}
+	if rules[2].Action != "deny" || rules[2].Proto() != "icmp" {
+		t.Fatalf("error parsing deny icmp rule %#v", rules[2])
+	}
+}
 
-    jsonData = []byte(`
-		{ "NetworkPolicy" : [{ "Name":"JunkPolicy", "Rules": ["permit tcp/666666"] }] }
-	`)
+func TestMissingOpsFile(t *testing.T) {
+	if err := loadOpsWithFile("/nonexistent/ops.json"); err == nil {
+		t.Fatalf("Successfully loaded a missing ops file")
+	}
+
+	writeTmpData(t, []byte(`{ "UserPolicy" : [ `))
+	if err := loadOpsWithFile(tmpFile); !errors.Is(err, ErrInvalidOps) {
+		t.Fatalf("unexpected error loading malformed ops file: %v", err)
+	}
+}
+
+func TestPortRangePolicy(t *testing.T) {
+    jsonData := []byte(`
+			{ "NetworkPolicy" : [
+				{ "Name":"Ftp", "Rules": ["permit tcp/20-21,990", "deny udp/10000-20000"] } ] }
+		`)
 
 	writeTmpData(t, jsonData)
 	if err := loadOpsWithFile(tmpFile); err != nil {
 		t.Fatalf("Error loading ops file: %s", err)
 	}
-	if _, err := GetRules("JunkPolicy"); err == nil {
-		t.Fatalf("Successfully loaded port beyond valid range")
+
+	rules, err := GetRules("Ftp")
+	if err != nil {
+		t.Fatalf("error fetching rules with port ranges: %s", err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("error parsing the rules %#v", rules)
+	}
+	if start, end, _ := rules[0].Range(); start != 20 || end != 21 || rules[0].Index != 0 {
+		t.Fatalf("error parsing port range %#v", rules[0])
+	}
+	if rules[1].Int() != 990 || rules[1].Index != 0 {
+		t.Fatalf("error parsing port list %#v", rules[1])
+	}
+	if start, end, _ := rules[2].Range(); rules[2].Proto() != "udp" || start != 10000 || end != 20000 || rules[2].Index != 1 {
+		t.Fatalf("error parsing udp port range %#v", rules[2])
 	}
 
-    jsonData = []byte(`
-			{ "NetworkPolicy" : [{ "Name":"JunkPolicy", "Rules": ["deny tcp/8080"] }] }
+	writeTmpData(t, []byte(`
+			{ "NetworkPolicy" : [
+				{ "Name":"BadRange", "Rules": ["permit tcp/21-20"] },
+				{ "Name":"BadList", "Rules": ["permit tcp/20,,21"] },
+				{ "Name":"ZeroBound", "Rules": ["permit tcp/0-100"] },
+				{ "Name":"Wide", "Rules": ["deny udp/10000-30000"] } ] }`))
+	err = loadOpsWithFile(tmpFile)
+	opsErr := &OpsError{}
+	if !errors.As(err, &opsErr) || len(opsErr.Problems) != 4 {
+		t.Fatalf("Successfully loaded invalid ports: %v", err)
+	}
+	for i, problem := range opsErr.Problems {
+		if problem.Path != fmt.Sprintf("$.NetworkPolicy[%d].Rules[0]", i) {
+			t.Fatalf("Unexpected problem %#v", problem)
+		}
+	}
+
+	if _, err := ParseRules("ZeroBound", []string{"permit tcp/0-100"}); !errors.Is(err, ErrInvalidRule) {
+		t.Fatalf("Parsed a range starting at port 0: %v", err)
+	}
+	if _, err := ParseRules("Wide", []string{"deny udp/10000-30000"}); !errors.Is(err, ErrInvalidRule) {
+		t.Fatalf("Parsed a range wider than %d ports: %v", PORT_RANGE_MAX, err)
+	}
+	if rules, err := ParseRules("All", []string{"permit tcp/1-65535"}); err != nil || len(rules) != 1 {
+		t.Fatalf("Unable to parse the full port range: %v", err)
+	}
+
+	clauses := make([]string, RULE_CLAUSES_MAX+1)
+	for i := range clauses {
+		clauses[i] = fmt.Sprintf("permit tcp/%d", 1000+i)
+	}
+	if _, err := ParseRules("Long", clauses[:RULE_CLAUSES_MAX]); err != nil {
+		t.Fatalf("Unable to parse %d clauses: %v", RULE_CLAUSES_MAX, err)
+	}
+	if _, err := ParseRules("Long", clauses); !errors.Is(err, ErrInvalidRule) {
+		t.Fatalf("Parsed more than %d clauses: %v", RULE_CLAUSES_MAX, err)
+	}
+
+	// and so does loading them
+	longRules, _ := json.Marshal(clauses)
+	writeTmpData(t, []byte(fmt.Sprintf(`
+			{ "NetworkPolicy" : [
+				{ "Name":"Long", "Rules": %s },
+				{ "Name":"LongEgress", "Rules": ["permit tcp/80"], "Egress": %s } ],
+			  "Contracts" : [ { "Consumer":"web", "Provider":"redis", "Rules": %s } ] }`, longRules, longRules, longRules)))
+	err = loadOpsWithFile(tmpFile)
+	if !errors.As(err, &opsErr) || len(opsErr.Problems) != 3 || opsErr.Problems[0].Path != "$.NetworkPolicy[0].Rules" ||
+		opsErr.Problems[1].Path != "$.NetworkPolicy[1].Egress" || opsErr.Problems[2].Path != "$.Contracts[0].Rules" {
+		t.Fatalf("Loaded more than %d clauses: %v", RULE_CLAUSES_MAX, err)
+	}
+}
+
+func TestEgressNetworkPolicy(t *testing.T) {
+    jsonData := []byte(`
+			{ "NetworkPolicy" : [
+				{ "Name":"Web", "Rules": ["permit tcp/80"], "Egress": ["permit tcp/443"] },
+				{ "Name":"Isolated", "Rules": ["permit tcp/6379"], "Egress": [] },
+				{ "Name":"Open", "Rules": ["permit tcp/22"] } ] }
 		`)
 
 	writeTmpData(t, jsonData)
 	if err := loadOpsWithFile(tmpFile); err != nil {
 		t.Fatalf("Error loading ops file: %s", err)
 	}
-	if _, err := GetRules("JunkPolicy"); err == nil {
-		t.Fatalf("Successfully loaded deny rule port")
+
+	rules, err := GetEgressRules("Web")
+	if err != nil || len(rules) != 1 || rules[0].Int() != 443 {
+		t.Fatalf("error fetching egress rules %#v: %v", rules, err)
+	}
+
+	rules, err = GetEgressRules("Isolated")
+	if err != nil || rules == nil || len(rules) != 0 {
+		t.Fatalf("error fetching empty egress rules %#v: %v", rules, err)
+	}
+
+	rules, err = GetEgressRules("Open")
+	if err != nil || rules != nil {
+		t.Fatalf("unrestricted egress returned rules %#v: %v", rules, err)
+	}
+
+	if _, err := GetEgressRules("Unknown"); !errors.Is(err, ErrPolicyNotFound) {
+		t.Fatalf("error validating unknown policy: %v", err)
+	}
+
+	writeTmpData(t, []byte(`{ "NetworkPolicy" : [ { "Name":"Junk", "Rules": ["permit tcp/22"], "Egress": ["permit tcp/x"] } ] }`))
+	opsErr := &OpsError{}
+	if err := loadOpsWithFile(tmpFile); !errors.As(err, &opsErr) || opsErr.Problems[0].Path != "$.NetworkPolicy[0].Egress[0]" {
+		t.Fatalf("Successfully loaded invalid egress rule: %v", err)
+	}
+}
+
+func TestExposeFromPolicy(t *testing.T) {
+    jsonData := []byte(`
+			{ "NetworkPolicy" : [
+				{ "Name":"Web", "Rules": ["permit tcp/80"], "ExposeFrom": ["10.1.0.0/16", "192.168.1.7/32"] } ] }
+		`)
+
+	writeTmpData(t, jsonData)
+	if err := loadOpsWithFile(tmpFile); err != nil {
+		t.Fatalf("Error loading ops file: %s", err)
+	}
+	cidrs, err := GetExposeFrom("Web")
+	if err != nil || len(cidrs) != 2 || cidrs[0] != "10.1.0.0/16" || cidrs[1] != "192.168.1.7/32" {
+		t.Fatalf("unexpected expose sources %v %v", cidrs, err)
+	}
+	if cidrs, err := GetExposeFrom("Unknown"); err != nil || len(cidrs) != 0 {
+		t.Fatalf("unexpected expose sources for unknown policy %v %v", cidrs, err)
+	}
+
+	// an invalid cidr is an error, not open to anyone
+	s := NewStore("")
+	s.policy.Store(&opsPolicy{NetworkPolicy: []NetworkPolicyInfo{{Name: "Web", ExposeFrom: []string{"office"}}}})
+	UseStore(s)
+	if cidrs, err := GetExposeFrom("Web"); !errors.Is(err, ErrInvalidCIDR) {
+		t.Fatalf("invalid expose source returned as %v", cidrs)
+	}
+	UseStore(NewStore(""))
+
+	for _, cidr := range []string{"10.1.0.0", "10.1.0.0/33", "office"} {
+		writeTmpData(t, []byte(`{ "NetworkPolicy" : [ { "Name":"Web", "ExposeFrom": ["`+cidr+`"] } ] }`))
+		if err := loadOpsWithFile(tmpFile); !errors.Is(err, ErrInvalidOps) {
+			t.Fatalf("Successfully loaded invalid cidr '%s'", cidr)
+		}
+	}
+}
+
+func TestGroupPolicy(t *testing.T) {
+    jsonData := []byte(`
+			{
+			"UserPolicy" : [
+					{ "Group":"dev",
+					  "Networks": "dev,test",
+					  "DefaultNetwork": "dev",
+					  "NetworkPolicies": "AllPriviliges",
+					  "DefaultNetworkPolicy": "AllPriviliges" },
+					{ "Group":"dba",
+					  "Networks": "db",
+					  "NetworkPolicies": "RedisDefault" },
+					{ "User":"alice",
+					  "Networks": "prod" }
+				],
+			"NetworkPolicy" : [
+					{ "Name":"AllPriviliges", "Rules": ["permit all"] },
+					{ "Name":"RedisDefault", "Rules": ["permit tcp/6379"] }
+				]
+			}
+		`)
+
+	writeTmpData(t, jsonData)
+	if err := loadOpsWithFile(tmpFile); err != nil {
+		t.Fatalf("error loading ops with file %s \n", err)
+	}
+
+	// permissions of all groups are merged
+	if err := UserOpsCheckNetwork("bob", "db", "dev", "dba"); err != nil {
+		t.Fatalf("group member denied network of its group: %s", err)
+	}
+	if err := UserOpsCheckNetworkPolicy("bob", "RedisDefault", "dev", "dba"); err != nil {
+		t.Fatalf("group member denied policy of its group: %s", err)
+	}
+	if err := UserOpsCheckNetwork("bob", "db", "dev"); !errors.Is(err, ErrNetworkDenied) {
+		t.Fatalf("user allowed network of a group it is not in: %v", err)
+	}
+	if err := UserOpsCheckNetwork("bob", "dev"); !errors.Is(err, ErrNetworkDenied) {
+		t.Fatalf("user without groups allowed network: %v", err)
+	}
+
+	// fields of the user entry override those of its groups
+	if err := UserOpsCheckNetwork("alice", "prod", "dev"); err != nil {
+		t.Fatalf("user denied its own network: %s", err)
+	}
+	if err := UserOpsCheckNetwork("alice", "test", "dev"); !errors.Is(err, ErrNetworkDenied) {
+		t.Fatalf("user entry did not override group networks: %v", err)
+	}
+	if err := UserOpsCheckNetworkPolicy("alice", "AllPriviliges", "dev"); err != nil {
+		t.Fatalf("user denied policy of its group: %s", err)
+	}
+	if policy, err := UserOpsGetDefaultNetworkPolicy("alice", "dev"); err != nil || policy != "AllPriviliges" {
+		t.Fatalf("default policy of group not used: '%s' %v", policy, err)
+	}
+
+	writeTmpData(t, []byte(`{ "UserPolicy" : [ { "User":"alice", "Group":"dev", "Networks": "dev" } ] }`))
+	if err := loadOpsWithFile(tmpFile); !errors.Is(err, ErrInvalidOps) {
+		t.Fatalf("entry naming both user and group accepted: %v", err)
+	}
+
+	writeTmpData(t, []byte(`{ "UserPolicy" : [ { "Group":"dev", "Networks": "dev", "DefaultNetwork": "prod" } ] }`))
+	if err := loadOpsWithFile(tmpFile); !errors.Is(err, ErrInvalidOps) {
+		t.Fatalf("group default network outside its networks accepted: %v", err)
+	}
+}
+
+func TestTenantPolicy(t *testing.T) {
+    jsonData := []byte(`
+			{
+			"UserPolicy" : [
+					{ "User":"admin", "Tenants": "all", "Networks": "all" },
+					{ "User":"vagrant", "Tenants": "default,blue", "DefaultTenant": "blue",
+					  "Networks": "dev" },
+					{ "User":"guest", "Networks": "dev" },
+					{ "User":"ci", "DefaultTenant": "ci", "Networks": "dev" }
+				]
+			}
+		`)
+
+	writeTmpData(t, jsonData)
+	if err := loadOpsWithFile(tmpFile); err != nil {
+		t.Fatalf("error loading ops with file %s \n", err)
+	}
+
+	if err := UserOpsCheckTenant("admin", "red"); err != nil {
+		t.Fatalf("user denied tenant allowed by 'all': %s", err)
+	}
+	if err := UserOpsCheckTenant("vagrant", "blue"); err != nil {
+		t.Fatalf("user denied allowed tenant: %s", err)
+	}
+	if err := UserOpsCheckTenant("vagrant", "red"); !errors.Is(err, ErrTenantDenied) {
+		t.Fatalf("user allowed tenant not in its tenants: %v", err)
+	}
+	if tenant, err := UserOpsGetDefaultTenant("vagrant"); err != nil || tenant != "blue" {
+		t.Fatalf("unexpected default tenant '%s': %v", tenant, err)
+	}
+
+	// without Tenants a user is held to its default tenant
+	if err := UserOpsCheckTenant("guest", "default"); err != nil {
+		t.Fatalf("user denied the default tenant: %s", err)
+	}
+	if err := UserOpsCheckTenant("guest", "blue"); !errors.Is(err, ErrTenantDenied) {
+		t.Fatalf("user without tenants allowed tenant 'blue': %v", err)
+	}
+	if err := UserOpsCheckTenant("ci", "ci"); err != nil {
+		t.Fatalf("user denied its default tenant: %s", err)
+	}
+	if err := UserOpsCheckTenant("ci", "default"); !errors.Is(err, ErrTenantDenied) {
+		t.Fatalf("user allowed tenant other than its default: %v", err)
+	}
+
+	writeTmpData(t, []byte(`{ "UserPolicy" : [ { "User":"vagrant", "Tenants": "default", "DefaultTenant": "blue" } ] }`))
+	if err := loadOpsWithFile(tmpFile); !errors.Is(err, ErrInvalidOps) {
+		t.Fatalf("default tenant outside allowed tenants accepted: %v", err)
+	}
+}
+
+func TestListPolicy(t *testing.T) {
+    jsonData := []byte(`
+			{
+			"Version": 1,
+			"UserPolicy" : [
+					{ "User":"vagrant",
+					  "Networks": "test, dev",
+					  "DefaultNetwork": "dev",
+					  "NetworkPolicies": [ "TrustApp", " RedisDefault " ],
+					  "DefaultNetworkPolicy": "RedisDefault" }
+				],
+			"NetworkPolicy" : [
+					{ "Name":"TrustApp", "Rules": ["permit app"] },
+					{ "Name":"RedisDefault", "Rules": ["permit tcp/6379"] }
+				]
+			}
+		`)
+
+	writeTmpData(t, jsonData)
+	if err := loadOpsWithFile(tmpFile); err != nil {
+		t.Fatalf("error loading ops with file %s \n", err)
+	}
+
+	if err := UserOpsCheckNetwork("vagrant", "dev"); err != nil {
+		t.Fatalf("blanks in the legacy list form not trimmed: %s", err)
+	}
+	if err := UserOpsCheckNetworkPolicy("vagrant", "RedisDefault"); err != nil {
+		t.Fatalf("blanks in the list not trimmed: %s", err)
+	}
+	if err := UserOpsCheckNetworkPolicy("vagrant", "WebDefault"); !errors.Is(err, ErrPolicyDenied) {
+		t.Fatalf("user allowed policy not in its list: %v", err)
+	}
+
+	for _, data := range []string{
+		`{ "UserPolicy" : [ { "User":"vagrant", "Networks": [ "dev", "test", "dev" ] } ] }`,
+		`{ "UserPolicy" : [ { "User":"vagrant", "NetworkPolicies": "TrustApp,TrustApp" } ] }`,
+		`{ "UserPolicy" : [ { "User":"vagrant", "Networks": [ 1 ] } ] }`,
+		`{ "Version": 2, "UserPolicy" : [ ] }`,
+	} {
+		writeTmpData(t, []byte(data))
+		if err := loadOpsWithFile(tmpFile); !errors.Is(err, ErrInvalidOps) {
+			t.Fatalf("invalid ops file accepted: %v\n%s", err, data)
+		}
+	}
+}
+
+func TestStrictOps(t *testing.T) {
+	if err := loadOpsWithFile("../example/ops.json"); err != nil {
+		t.Fatalf("error loading the example ops file: %s", err)
+	}
+
+    jsonData := []byte(`
+			{
+			"LabelMap`+"`"+`" : { "Tenant" : "io.contiv.tenant" },
+			"UserPolicy" : [
+					{ "User":"vagrant", "Netwroks": "dev", "NetworkPolicies": "TrustApp,Missing" },
+					{ "User":"vagrant", "Networks": "dev" },
+					{ "Networks": "dev" }
+				],
+			"NetworkPolicy" : [
+					{ "Name":"TrustApp", "Rules": ["permit app"] },
+					{ "Name":"TrustApp", "Rules": ["permit tcp/80"] }
+				]
+			}
+		`)
+
+	writeTmpData(t, jsonData)
+	err := loadOpsWithFile(tmpFile)
+	opsErr := &OpsError{}
+	if !errors.Is(err, ErrInvalidOps) || !errors.As(err, &opsErr) || opsErr.File != tmpFile {
+		t.Fatalf("Successfully loaded invalid ops file: %v", err)
+	}
+
+	expected := []string{
+		"$.LabelMap`",
+		"$.UserPolicy[0].Netwroks",
+		"$.NetworkPolicy[1].Name",
+		"$.UserPolicy[0].NetworkPolicies",
+		"$.UserPolicy[1]",
+		"$.UserPolicy[2]",
+	}
+	if len(opsErr.Problems) != len(expected) {
+		t.Fatalf("unexpected problems: %v", err)
+	}
+	found := map[string]bool{}
+	for _, problem := range opsErr.Problems {
+		if problem.File != tmpFile {
+			t.Fatalf("problem located in '%s': %v", problem.File, err)
+		}
+		found[problem.Path] = true
+	}
+	for _, path := range expected {
+		if !found[path] {
+			t.Fatalf("no problem reported at '%s': %v", path, err)
+		}
+	}
+
+	// a failed load keeps the policies loaded before
+	if LabelOpsGetTenant() != "io.contiv.tenant" || UserOpsCheckNetwork("vagrant", "dev") != nil {
+		t.Fatalf("invalid ops file replaced the loaded policies")
+	}
+}
+
+func TestContracts(t *testing.T) {
+	jsonData := []byte(`
+			{
+			"Contracts" : [
+					{ "Consumer":"web", "Provider":"redis", "Rules": ["permit tcp/6379"] },
+					{ "Consumer":"worker", "Provider":"redis", "Rules": ["permit tcp/6379,6380"] },
+					{ "Project":"shop", "Consumer":"worker", "Provider":"redis", "Rules": ["permit tcp/6381"] },
+					{ "Project":"shop", "Consumer":"web", "Provider":"db", "Rules": ["permit tcp/5432"] }
+				]
+			}
+		`)
+
+	writeTmpData(t, jsonData)
+	if err := loadOpsWithFile(tmpFile); err != nil {
+		t.Fatalf("error loading ops with file %s \n", err)
+	}
+
+	// contracts without a project hold in every project
+	rules, err := GetContractRules("example", "worker", "redis")
+	if err != nil || len(rules) != 2 || rules[1].Int() != 6380 {
+		t.Fatalf("unexpected rules of contract 'worker -> redis': %v %v", rules, err)
+	}
+	if rules, err := GetContractRules("example", "redis", "web"); err != nil || rules != nil {
+		t.Fatalf("rules found for no contract: %v %v", rules, err)
+	}
+	if providers := GetContractProviders("example", "web"); len(providers) != 1 || providers[0] != "redis" {
+		t.Fatalf("unexpected providers of 'web': %v", providers)
+	}
+
+	// those of a project take precedence there, and hold nowhere else
+	rules, err = GetContractRules("shop", "worker", "redis")
+	if err != nil || len(rules) != 1 || rules[0].Int() != 6381 {
+		t.Fatalf("unexpected rules of contract 'worker -> redis' in 'shop': %v %v", rules, err)
+	}
+	if rules, err := GetContractRules("example", "web", "db"); err != nil || rules != nil {
+		t.Fatalf("contract of project 'shop' found in 'example': %v %v", rules, err)
+	}
+	if providers := GetContractProviders("shop", "web"); fmt.Sprint(providers) != "[redis db]" {
+		t.Fatalf("unexpected providers of 'web' in 'shop': %v", providers)
+	}
+	if providers := GetContractProviders("shop", "worker"); len(providers) != 1 {
+		t.Fatalf("provider listed twice: %v", providers)
+	}
+
+	writeTmpData(t, []byte(`
+			{
+			"Contracts" : [
+					{ "Consumer":"web", "Rules": ["permit tcp/6379"] },
+					{ "Consumer":"worker", "Provider":"redis", "Rules": ["permit tcp/x"] },
+					{ "Consumer":"worker", "Provider":"redis" },
+					{ "Project":"shop", "Consumer":"worker", "Provider":"redis", "Rules": ["permit tcp/6379"] },
+					{ "Project":"shop", "Consumer":"worker", "Provider":"redis", "Rules": ["permit tcp/6380"] }
+				]
+			}
+		`))
+	err = loadOpsWithFile(tmpFile)
+	opsErr := &OpsError{}
+	if !errors.As(err, &opsErr) {
+		t.Fatalf("Successfully loaded invalid contracts: %v", err)
+	}
+	expected := []string{"$.Contracts[0]", "$.Contracts[1].Rules[0]", "$.Contracts[2]", "$.Contracts[2].Rules", "$.Contracts[4]"}
+	if len(opsErr.Problems) != len(expected) {
+		t.Fatalf("unexpected problems: %v", err)
+	}
+	for i, path := range expected {
+		if opsErr.Problems[i].Path != path {
+			t.Fatalf("problem %d at '%s', expected '%s': %v", i, opsErr.Problems[i].Path, path, err)
+		}
 	}
 }
@@ -0,0 +1,203 @@
+package ops
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// OPS_FILE_ENV names the project ops file when none is passed explicitly
+	OPS_FILE_ENV = "CONTIV_OPS_FILE"
+
+	opsFileName = "ops.json"
+)
+
+// Store holds the ops policies merged from the layers of ops files. A load
+// replaces the policies at once, after all files are read and validated, so
+// that readers see either the old or the new policies; a failed load keeps
+// the old ones.
+type Store struct {
+	projectFile  string
+	composeFiles []string
+
+	// mu serializes loads; readers go through policy only
+	mu       sync.Mutex
+	layers   []Layer
+	modTimes map[string]time.Time
+	policy   atomic.Value
+}
+
+// NewStore returns a store reading the default layers, with the given file
+// as the project layer if the name is not empty, and then the policies of
+// the compose files given. Nothing is read until Load.
+func NewStore(projectFile string, composeFiles ...string) *Store {
+	s := &Store{projectFile: projectFile, composeFiles: composeFiles}
+	s.policy.Store(&opsPolicy{})
+	return s
+}
+
+// Load reads and merges the ops files and replaces the policies held
+func (s *Store) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	layers := DefaultLayers(s.projectFile)
+	if len(layers) == 0 {
+		err := fmt.Errorf("no ops file found: %w", os.ErrNotExist)
+		log.Errorf("Unable to find ops policies: %s", err)
+		return err
+	}
+	layers = append(layers, s.composeLayers()...)
+
+	merged := &opsPolicy{}
+	modTimes := make(map[string]time.Time)
+	opsErr := &OpsError{File: topFile(layers)}
+	for _, layer := range layers {
+		info, err := os.Stat(layer.File)
+		if err != nil {
+			log.Errorf("error reading the config file: %s", err)
+			return err
+		}
+		modTimes[layer.File] = info.ModTime()
+
+		var policy *opsPolicy
+		if layer.Name == LAYER_COMPOSE {
+			policy, err = parseComposeFile(layer.File)
+		} else {
+			policy, err = parseOpsFile(layer.File)
+		}
+		layerErr := &OpsError{}
+		if errors.As(err, &layerErr) {
+			opsErr.Problems = append(opsErr.Problems, layerErr.Problems...)
+		} else if err != nil {
+			return err
+		}
+		if policy != nil {
+			opsErr.Problems = append(opsErr.Problems, merged.merge(layer, policy)...)
+		}
+	}
+	opsErr.Problems = append(opsErr.Problems, merged.validate()...)
+	if len(opsErr.Problems) != 0 {
+		for _, problem := range opsErr.Problems {
+			log.Errorf("%s: %s: %s", problem.File, problem.Path, problem.Reason)
+		}
+		return opsErr
+	}
+
+	s.policy.Store(merged)
+	s.layers, s.modTimes = layers, modTimes
+	for _, origin := range merged.origins() {
+		log.Debugf("Using %s '%s' from the %s layer '%s'", origin.Kind, origin.Name, origin.Layer, origin.File)
+	}
+
+	return nil
+}
+
+// Layers returns the files the policies were last loaded from, from the
+// lowest precedence to the highest
+func (s *Store) Layers() []Layer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Layer{}, s.layers...)
+}
+
+// composeLayers lists the compose files of the project, in the order given
+func (s *Store) composeLayers() []Layer {
+	layers := []Layer{}
+	for _, composeFile := range s.composeFiles {
+		layers = append(layers, Layer{Name: LAYER_COMPOSE, File: composeFile})
+	}
+	return layers
+}
+
+// topFile returns the ops file of highest precedence among layers
+func topFile(layers []Layer) string {
+	for i := len(layers) - 1; i >= 0; i-- {
+		if layers[i].Name != LAYER_COMPOSE {
+			return layers[i].File
+		}
+	}
+	return ""
+}
+
+// File returns the ops file of highest precedence the policies were last
+// loaded from
+func (s *Store) File() string {
+	return topFile(s.Layers())
+}
+
+// changed tells whether files were added to or removed from the layers
+// loaded, or modified since
+func (s *Store) changed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	layers := append(DefaultLayers(s.projectFile), s.composeLayers()...)
+	if len(layers) != len(s.layers) {
+		return true
+	}
+	for i, layer := range layers {
+		if layer != s.layers[i] {
+			return true
+		}
+		info, err := os.Stat(layer.File)
+		if err != nil || !info.ModTime().Equal(s.modTimes[layer.File]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the policies whenever an ops file is added, removed or
+// changed, or a compose file changed, checking every interval until stop is closed. Files that do not
+// load are logged and the policies held are kept.
+func (s *Store) Watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if !s.changed() {
+				continue
+			}
+			if err := s.Load(); err != nil {
+				log.Errorf("Keeping the ops policies from '%s': %s", s.File(), err)
+				continue
+			}
+			log.Infof("Reloaded ops policies from '%s'", s.File())
+		}
+	}
+}
+
+func (s *Store) get() *opsPolicy {
+	return s.policy.Load().(*opsPolicy)
+}
+
+var defaultStore atomic.Value
+
+func init() {
+	defaultStore.Store(NewStore(""))
+}
+
+// UseStore makes the package level functions read the policies of s
+func UseStore(s *Store) {
+	defaultStore.Store(s)
+}
+
+// CurrentStore returns the store the package level functions read from
+func CurrentStore() *Store {
+	return defaultStore.Load().(*Store)
+}
+
+func current() *opsPolicy {
+	return CurrentStore().get()
+}
@@ -0,0 +1,419 @@
+package ops
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func writeLayer(t *testing.T, fileName, jsonData string) {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		t.Fatalf("error creating dir: %s", err)
+	}
+	if err := ioutil.WriteFile(fileName, []byte(jsonData), 0644); err != nil {
+		t.Fatalf("error writing to tmp file %#v", err)
+	}
+}
+
+func TestLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ops")
+	if err != nil {
+		t.Fatalf("error creating tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "home"))
+	os.Setenv("XDG_CONFIG_DIRS", filepath.Join(dir, "etc"))
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+	defer os.Unsetenv("XDG_CONFIG_DIRS")
+
+	if _, err := os.Stat("ops.json"); err == nil {
+		t.Skipf("ops.json in the working directory")
+	}
+	if err := NewStore("").Load(); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unexpected error without an ops file: %v", err)
+	}
+
+	systemFile := filepath.Join(dir, "etc", "contiv", "ops.json")
+	writeLayer(t, systemFile, `{
+		"LabelMap" : { "Tenant" : "io.contiv.tenant", "NetworkIsolationPolicy" : "io.contiv.policy" },
+		"NetworkPolicy" : [
+			{ "Name":"AllPriviliges", "Rules": ["permit all"] },
+			{ "Name":"RedisDefault", "Rules": ["permit tcp/6379"] } ],
+		"UserPolicy" : [ { "Group":"dev", "Networks": "dev", "NetworkPolicies": "RedisDefault" } ] }`)
+	teamFile := filepath.Join(dir, "etc", "contiv", "ops.d", "10-web.json")
+	writeLayer(t, teamFile, `{
+		"NetworkPolicy" : [
+			{ "Name":"WebDefault", "Rules": ["permit tcp/80"] },
+			{ "Name":"RedisDefault", "Rules": ["permit tcp/6380"] } ],
+		"UserPolicy" : [
+			{ "Group":"dev", "Networks": "dev,web", "NetworkPolicies": "RedisDefault,WebDefault" },
+			{ "User":"vagrant", "Networks": "dev", "NetworkPolicies": "WebDefault" } ] }`)
+	projectFile := filepath.Join(dir, "project", "ops.json")
+	writeLayer(t, projectFile, `{
+		"LabelMap" : { "Tenant" : "tenant" },
+		"NetworkPolicy" : [ { "Name":"RedisLocal", "Rules": ["permit tcp/6381"] } ] }`)
+
+	s := NewStore(projectFile)
+	if err := s.Load(); err != nil {
+		t.Fatalf("error loading layers: %s", err)
+	}
+	layers := s.Layers()
+	if len(layers) != 3 || layers[0].Name != LAYER_SYSTEM || layers[1].File != teamFile ||
+		layers[2].Name != LAYER_PROJECT || s.File() != projectFile {
+		t.Fatalf("unexpected layers %v", layers)
+	}
+	UseStore(s)
+	defer UseStore(NewStore(""))
+
+	// sections are overridden field by field
+	if LabelOpsGetTenant() != "tenant" || LabelOpsGetNetworkIsolationPolicy() != "io.contiv.policy" {
+		t.Fatalf("label map not merged: %#v", current().LabelMap)
+	}
+
+	// entries are replaced as a whole by the higher layer
+	if err := UserOpsCheckNetwork("bob", "web", "dev"); err != nil {
+		t.Fatalf("group entry of the team layer not used: %s", err)
+	}
+	rules, err := GetRules("RedisDefault")
+	if err != nil || len(rules) != 1 || rules[0].Int() != 6380 {
+		t.Fatalf("policy of the team layer not used: %v %v", rules, err)
+	}
+	if origin, ok := PolicyOrigin("RedisDefault"); !ok || origin.Layer != LAYER_TEAM || origin.File != teamFile {
+		t.Fatalf("unexpected origin of policy 'RedisDefault': %#v", origin)
+	}
+	if origin, ok := PolicyOrigin("RedisLocal"); !ok || origin.Layer != LAYER_PROJECT || origin.File != projectFile {
+		t.Fatalf("unexpected origin of policy 'RedisLocal': %#v", origin)
+	}
+	if origin, ok := PolicyOrigin("AllPriviliges"); !ok || origin.Layer != LAYER_SYSTEM {
+		t.Fatalf("unexpected origin of policy 'AllPriviliges': %#v", origin)
+	}
+	origins := map[string]Origin{}
+	for _, origin := range Origins() {
+		origins[origin.Kind+":"+origin.Name] = origin
+	}
+	if origins["group:dev"].File != teamFile || origins["user:vagrant"].Layer != LAYER_TEAM ||
+		origins["policy:RedisLocal"].Layer != LAYER_PROJECT {
+		t.Fatalf("unexpected origins %v", origins)
+	}
+
+	// problems are located in the file of the entry
+	writeLayer(t, projectFile, `{ "DefaultNetwork": "dev" }`)
+	writeLayer(t, systemFile, `{ "UserPolicy" : [ { "User":"alice", "NetworkPolicies": "Missing" } ] }`)
+	err = NewStore(projectFile).Load()
+	opsErr := &OpsError{}
+	if !errors.As(err, &opsErr) || len(opsErr.Problems) != 1 || opsErr.Problems[0].File != systemFile ||
+		opsErr.Problems[0].Path != "$.UserPolicy[0].NetworkPolicies" {
+		t.Fatalf("problem not located: %v", err)
+	}
+	writeLayer(t, systemFile, `{ "NetworkPolicy" : [ { "Name":"AllPriviliges", "Rules": ["permit all"] } ] }`)
+
+	// the project file may also come from the environment
+	os.Setenv(OPS_FILE_ENV, teamFile)
+	defer os.Unsetenv(OPS_FILE_ENV)
+	s = NewStore("")
+	if err := s.Load(); err != nil || len(s.Layers()) != 2 || s.File() != teamFile {
+		t.Fatalf("ops file from the environment not used: %v %v", s.Layers(), err)
+	}
+}
+
+func TestLayerTrust(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ops")
+	if err != nil {
+		t.Fatalf("error creating tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "home"))
+	os.Setenv("XDG_CONFIG_DIRS", filepath.Join(dir, "etc"))
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+	defer os.Unsetenv("XDG_CONFIG_DIRS")
+
+	writeLayer(t, filepath.Join(dir, "etc", "contiv", "ops.json"), `{
+		"Netmaster" : { "URL" : "https://netmaster:9999" },
+		"Identity" : { "Provider" : "token", "TokenKeyFile" : "/etc/contiv/token.pem" },
+		"NetworkPolicy" : [ { "Name":"RedisDefault", "Rules": ["permit tcp/6379"] } ],
+		"UserPolicy" : [ { "Group":"dev", "Networks": "dev", "NetworkPolicies": "RedisDefault" } ],
+		"Contracts" : [ { "Consumer":"web", "Provider":"redis", "Rules": ["permit tcp/6379"] } ] }`)
+	writeLayer(t, filepath.Join(dir, "home", "contiv", "ops.json"), `{
+		"Identity" : { "Provider" : "os" },
+		"NetworkPolicy" : [ { "Name":"RedisDefault", "Rules": ["permit all"] } ] }`)
+	projectFile := filepath.Join(dir, "project", "ops.json")
+	writeLayer(t, projectFile, `{
+		"LabelMap" : { "Tenant" : "tenant" },
+		"Netmaster" : { "URL" : "http://evil:9999", "Token" : "secret" },
+		"UserPolicy" : [
+			{ "Group":"dev", "Networks": "all", "NetworkPolicies": "all" },
+			{ "User":"vagrant", "Tenants": "all", "Networks": "all", "NetworkPolicies": "all" } ],
+		"Contracts" : [
+			{ "Consumer":"web", "Provider":"redis", "Rules": ["permit all"] },
+			{ "Project":"example", "Consumer":"web", "Provider":"redis", "Rules": ["permit all"] } ] }`)
+
+	err = NewStore(projectFile).Load()
+	opsErr := &OpsError{}
+	if !errors.Is(err, ErrInvalidOps) || !errors.As(err, &opsErr) {
+		t.Fatalf("lower-trust layers overrode the system layer: %v", err)
+	}
+	paths := []string{}
+	for _, problem := range opsErr.Problems {
+		paths = append(paths, problem.Path)
+	}
+	sort.Strings(paths)
+	expPaths := []string{"$.Contracts[0]", "$.Contracts[1]", "$.Identity.Provider", "$.Netmaster.URL",
+		"$.NetworkPolicy[0].Name", "$.UserPolicy[0]", "$.UserPolicy[1]"}
+	if fmt.Sprint(paths) != fmt.Sprint(expPaths) {
+		t.Fatalf("got problems at %v, expected %v", paths, expPaths)
+	}
+
+	// adding policies and settings the system layer leaves unset is fine
+	writeLayer(t, filepath.Join(dir, "home", "contiv", "ops.json"), `{
+		"NetworkPolicy" : [ { "Name":"RedisLocal", "Rules": ["permit tcp/6380"] } ] }`)
+	writeLayer(t, projectFile, `{
+		"LabelMap" : { "Tenant" : "tenant" },
+		"Netmaster" : { "Token" : "secret" },
+		"Contracts" : [ { "Consumer":"worker", "Provider":"redis", "Rules": ["permit tcp/6379"] } ] }`)
+	s := NewStore(projectFile)
+	if err := s.Load(); err != nil {
+		t.Fatalf("error loading layers: %s", err)
+	}
+	UseStore(s)
+	defer UseStore(NewStore(""))
+	if current().Netmaster.URL != "https://netmaster:9999" || current().Netmaster.Token != "secret" ||
+		LabelOpsGetTenant() != "tenant" {
+		t.Fatalf("settings not merged: %#v %#v", current().Netmaster, current().LabelMap)
+	}
+	if rules, err := GetContractRules("example", "web", "redis"); err != nil || len(rules) != 1 || rules[0].Int() != 6379 {
+		t.Fatalf("contract of the system layer not used: %v %v", rules, err)
+	}
+	if providers := GetContractProviders("example", "worker"); len(providers) != 1 {
+		t.Fatalf("contract of the project layer not added: %v", providers)
+	}
+	// users keep the grants of their groups
+	if err := UserOpsCheckNetwork("vagrant", "test", "dev"); !errors.Is(err, ErrNetworkDenied) {
+		t.Fatalf("user granted beyond the system layer: %v", err)
+	}
+	if err := UserOpsCheckNetwork("vagrant", "dev", "dev"); err != nil {
+		t.Fatalf("group grant of the system layer not used: %s", err)
+	}
+}
+
+func TestStoreWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ops")
+	if err != nil {
+		t.Fatalf("error creating tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := filepath.Join(dir, "ops.json")
+	ioutil.WriteFile(fileName, []byte(`{ "UserPolicy" : [ { "User":"vagrant", "Networks": "dev" } ] }`), 0644)
+
+	s := NewStore(fileName)
+	if err := s.Load(); err != nil {
+		t.Fatalf("error loading ops file: %s", err)
+	}
+	UseStore(s)
+	defer UseStore(NewStore(""))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.Watch(10*time.Millisecond, stop)
+
+	// readers see either the old or the new policies, never a mix
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				networks := current().getUserPolicy("vagrant", nil).Networks
+				if len(networks) != 1 || (networks[0] != "dev" && networks[0] != "test") {
+					t.Errorf("half loaded policies seen: %v", networks)
+					return
+				}
+			}
+		}()
+	}
+
+	waitFor := func(network string) bool {
+		for i := 0; i < 200; i++ {
+			if UserOpsCheckNetwork("vagrant", network) == nil {
+				return true
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return false
+	}
+
+	modTime := time.Now().Add(time.Second)
+	ioutil.WriteFile(fileName, []byte(`{ "UserPolicy" : [ { "User":"vagrant", "Networks": "test" } ] }`), 0644)
+	os.Chtimes(fileName, modTime, modTime)
+	if !waitFor("test") {
+		t.Fatalf("changed ops file not reloaded")
+	}
+
+	// an invalid file keeps the policies loaded before
+	ioutil.WriteFile(fileName, []byte(`{ "UserPolicy" : [ { "User":"vagrant", "Netwroks": "dev" } ] }`), 0644)
+	modTime = modTime.Add(time.Second)
+	os.Chtimes(fileName, modTime, modTime)
+	time.Sleep(50 * time.Millisecond)
+	if UserOpsCheckNetwork("vagrant", "test") != nil {
+		t.Fatalf("invalid ops file replaced the loaded policies")
+	}
+
+	close(done)
+	wg.Wait()
+}
+
+func TestYAMLLayers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ops")
+	if err != nil {
+		t.Fatalf("error creating tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("XDG_CONFIG_HOME", filepath.Join(dir, "home"))
+	os.Setenv("XDG_CONFIG_DIRS", filepath.Join(dir, "etc"))
+	defer os.Unsetenv("XDG_CONFIG_HOME")
+	defer os.Unsetenv("XDG_CONFIG_DIRS")
+
+	systemFile := filepath.Join(dir, "etc", "contiv", "ops.yaml")
+	writeLayer(t, systemFile, `
+Version: 1
+NetworkPolicy:
+  - Name: RedisDefault
+    Rules: [ "permit tcp/6379" ]
+UserPolicy:
+  - User: vagrant
+    Networks: [ dev, test ]
+    NetworkPolicies: RedisDefault
+`)
+	teamFile := filepath.Join(dir, "etc", "contiv", "ops.d", "10-web.yml")
+	writeLayer(t, teamFile, `
+UserPolicy:
+  - User: vagrant
+    Netwroks: dev
+`)
+	projectFile := filepath.Join(dir, "project", "ops.json")
+	writeLayer(t, projectFile, `{ "DefaultNetwork": "dev" }`)
+
+	err = NewStore(projectFile).Load()
+	opsErr := &OpsError{}
+	if !errors.As(err, &opsErr) || len(opsErr.Problems) != 1 || opsErr.Problems[0].File != teamFile ||
+		opsErr.Problems[0].Path != "$.UserPolicy[0].Netwroks" {
+		t.Fatalf("problem of the yaml file not located: %v", err)
+	}
+
+	os.Remove(teamFile)
+	s := NewStore(projectFile)
+	if err := s.Load(); err != nil {
+		t.Fatalf("error loading yaml layers: %s", err)
+	}
+	if layers := s.Layers(); len(layers) != 2 || layers[0].File != systemFile {
+		t.Fatalf("unexpected layers %v", layers)
+	}
+	UseStore(s)
+	defer UseStore(NewStore(""))
+
+	if err := UserOpsCheckNetwork("vagrant", "test"); err != nil {
+		t.Fatalf("user policy of the yaml file not used: %s", err)
+	}
+	if rules, err := GetRules("RedisDefault"); err != nil || len(rules) != 1 || rules[0].Int() != 6379 {
+		t.Fatalf("network policy of the yaml file not used: %v %v", rules, err)
+	}
+}
+
+func TestComposeLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ops")
+	if err != nil {
+		t.Fatalf("error creating tmp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opsFile := filepath.Join(dir, "ops.json")
+	writeLayer(t, opsFile, `{
+		"NetworkPolicy" : [ { "Name":"RedisDefault", "Rules": ["permit tcp/6379"] } ],
+		"UserPolicy" : [ { "User":"vagrant", "Networks": "dev", "NetworkPolicies": "RedisDefault,WebLocal" } ] }`)
+	composeFile := filepath.Join(dir, "docker-compose.yml")
+	writeLayer(t, composeFile, `
+version: "2"
+services:
+  web:
+    image: web
+x-contiv-policy:
+  NetworkPolicy:
+    - Name: WebLocal
+      Rules: [ "permit tcp/8080" ]
+`)
+	plainFile := filepath.Join(dir, "docker-compose.override.yml")
+	writeLayer(t, plainFile, `
+version: "2"
+services:
+  web:
+    image: web:latest
+`)
+
+	s := NewStore(opsFile, composeFile, plainFile)
+	if err := s.Load(); err != nil {
+		t.Fatalf("error loading compose policies: %s", err)
+	}
+	if layers := s.Layers(); len(layers) != 3 || layers[1].Name != LAYER_COMPOSE || s.File() != opsFile {
+		t.Fatalf("unexpected layers %v", layers)
+	}
+	UseStore(s)
+	defer UseStore(NewStore(""))
+
+	if rules, err := GetRules("WebLocal"); err != nil || len(rules) != 1 || rules[0].Int() != 8080 {
+		t.Fatalf("policy of the compose file not used: %v %v", rules, err)
+	}
+	if err := UserOpsCheckNetworkPolicy("vagrant", "WebLocal"); err != nil {
+		t.Fatalf("policy of the compose file denied: %s", err)
+	}
+	if origin, ok := PolicyOrigin("WebLocal"); !ok || origin.Layer != LAYER_COMPOSE || origin.File != composeFile {
+		t.Fatalf("unexpected origin of policy 'WebLocal': %#v", origin)
+	}
+
+	// the policies granted are checked against those of the compose files too
+	err = NewStore(opsFile, plainFile).Load()
+	if opsErr := (&OpsError{}); !errors.As(err, &opsErr) || len(opsErr.Problems) != 1 ||
+		opsErr.Problems[0].File != opsFile || opsErr.Problems[0].Path != "$.UserPolicy[0].NetworkPolicies" {
+		t.Fatalf("policy granted but not defined loaded: %v", err)
+	}
+
+	// compose files only add policies
+	writeLayer(t, composeFile, `
+version: "2"
+x-contiv-policy:
+  NetworkPolicy:
+    - Name: RedisDefault
+      Rules: [ "permit all" ]
+  UserPolicy:
+    - User: vagrant
+      Networks: all
+`)
+	err = NewStore(opsFile, composeFile).Load()
+	opsErr := &OpsError{}
+	if !errors.As(err, &opsErr) || len(opsErr.Problems) != 3 {
+		t.Fatalf("compose file overriding the ops files loaded: %v", err)
+	}
+	// WebLocal is no longer defined
+	for i, path := range []string{"$.x-contiv-policy.UserPolicy", "$.x-contiv-policy.NetworkPolicy[0].Name"} {
+		if opsErr.Problems[i].File != composeFile || opsErr.Problems[i].Path != path {
+			t.Fatalf("problem %d not located at '%s': %v", i, path, err)
+		}
+	}
+	if opsErr.Problems[2].File != opsFile || opsErr.Problems[2].Path != "$.UserPolicy[0].NetworkPolicies" {
+		t.Fatalf("undefined policy not reported: %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package ops
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+
+// jsonErrorPath locates a decoding error as precisely as encoding/json lets
+func jsonErrorPath(err error) string {
+	typeErr := &json.UnmarshalTypeError{}
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return "$." + typeErr.Field
+	}
+	return "$"
+}
+
+func findField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if field := t.Field(i); field.PkgPath == "" && strings.EqualFold(field.Name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// checkFields reports the keys of a decoded JSON value that have no field
+// in the type it is read into; values of the wrong type are left to
+// encoding/json
+func checkFields(path string, value interface{}, t reflect.Type) []OpsProblem {
+	problems := []OpsProblem{}
+	if reflect.PtrTo(t).Implements(unmarshalerType) {
+		return problems
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return problems
+		}
+		keys := []string{}
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field, ok := findField(t, key)
+			if !ok {
+				problems = append(problems, OpsProblem{Path: path + "." + key, Reason: "unknown field"})
+				continue
+			}
+			problems = append(problems, checkFields(path+"."+key, obj[key], field.Type)...)
+		}
+	case reflect.Slice:
+		list, ok := value.([]interface{})
+		if !ok {
+			return problems
+		}
+		for i, item := range list {
+			problems = append(problems, checkFields(fmt.Sprintf("%s[%d]", path, i), item, t.Elem())...)
+		}
+	}
+
+	return problems
+}
+
+// checkLayer checks what can be told from one ops file alone: the version,
+// duplicate entries and lists, and the rules of the policies and contracts
+func (o *opsPolicy) checkLayer(fileName string) []OpsProblem {
+	problems := []OpsProblem{}
+	problem := func(path, format string, args ...interface{}) {
+		problems = append(problems, OpsProblem{File: fileName, Path: path, Reason: fmt.Sprintf(format, args...)})
+	}
+
+	if o.Version < 0 || o.Version > opsVersion {
+		problem("$.Version", "unsupported version %d, expected at most %d", o.Version, opsVersion)
+	}
+
+	checkRules := func(path, name string, rules []string) {
+		if len(rules) > RULE_CLAUSES_MAX {
+			problem(path, "more than %d rules", RULE_CLAUSES_MAX)
+		}
+		for j, rule := range rules {
+			if _, err := parseRules(name, []string{rule}); err != nil {
+				reason := err.Error()
+				ruleErr := &RuleError{}
+				if errors.As(err, &ruleErr) {
+					reason = fmt.Sprintf("invalid rule '%s': %s", rule, ruleErr.Reason)
+				}
+				problem(fmt.Sprintf("%s[%d]", path, j), "%s", reason)
+			}
+		}
+	}
+
+	policyNames := make(map[string]string)
+	for i, policy := range o.NetworkPolicy {
+		path := fmt.Sprintf("$.NetworkPolicy[%d]", i)
+		if policy.Name == "" {
+			problem(path+".Name", "missing policy name")
+		} else if other, ok := policyNames[policy.Name]; ok {
+			problem(path+".Name", "policy '%s' already defined at %s", policy.Name, other)
+		} else {
+			policyNames[policy.Name] = path
+		}
+
+		checkRules(path+".Rules", policy.Name, policy.Rules)
+		checkRules(path+".Egress", policy.Name, policy.Egress)
+		for j, cidr := range policy.ExposeFrom {
+			if _, err := ParseCIDR(cidr); err != nil {
+				problem(fmt.Sprintf("%s.ExposeFrom[%d]", path, j), "%s", err)
+			}
+		}
+	}
+
+	contracts := make(map[string]string)
+	for i, contract := range o.Contracts {
+		path := fmt.Sprintf("$.Contracts[%d]", i)
+		name := ContractName(contract.Consumer, contract.Provider)
+		if contract.Consumer == "" || contract.Provider == "" {
+			problem(path, "names no consumer or no provider")
+		} else if other, ok := contracts[contractKey(contract)]; ok {
+			problem(path, "contract '%s' already defined at %s", contractKey(contract), other)
+		} else {
+			contracts[contractKey(contract)] = path
+		}
+		if len(contract.Rules) == 0 {
+			problem(path+".Rules", "missing rules")
+		}
+		checkRules(path+".Rules", name, contract.Rules)
+	}
+
+	entries := make(map[string]string)
+	for i, policy := range o.UserPolicy {
+		path := fmt.Sprintf("$.UserPolicy[%d]", i)
+		switch {
+		case policy.User != "" && policy.Group != "":
+			problem(path, "names both user '%s' and group '%s'", policy.User, policy.Group)
+		case policy.User == "" && policy.Group == "":
+			problem(path, "names neither a user nor a group")
+		default:
+			if other, ok := entries[entryName(policy)]; ok {
+				problem(path, "%s already listed at %s", entryName(policy), other)
+			} else {
+				entries[entryName(policy)] = path
+			}
+		}
+
+		for _, list := range []struct {
+			field string
+			kind  string
+			names StringList
+		}{
+			{"Tenants", "tenant", policy.Tenants},
+			{"Networks", "network", policy.Networks},
+			{"NetworkPolicies", "policy", policy.NetworkPolicies},
+		} {
+			if name, ok := list.names.duplicate(); ok {
+				problem(path+"."+list.field, "%s '%s' listed twice", list.kind, name)
+			}
+		}
+	}
+
+	return problems
+}
+
+// validate checks the references between the entries of the merged layers;
+// problems are located in the file each entry came from
+func (o *opsPolicy) validate() []OpsProblem {
+	problems := []OpsProblem{}
+
+	policyNames := make(map[string]bool)
+	for _, policy := range o.NetworkPolicy {
+		policyNames[policy.Name] = true
+	}
+
+	for i, policy := range o.UserPolicy {
+		origin := o.userOrigins[i]
+		problem := func(field, format string, args ...interface{}) {
+			problems = append(problems, OpsProblem{
+				File:   origin.File,
+				Path:   fmt.Sprintf("$.UserPolicy[%d]%s", origin.Index, field),
+				Reason: fmt.Sprintf(format, args...),
+			})
+		}
+
+		// policies granted are defined by the ops files or by the compose
+		// files of the project loaded with them
+		for _, name := range policy.NetworkPolicies {
+			if !policyNames[name] && name != "all" {
+				problem(".NetworkPolicies", "undefined policy '%s'", name)
+			}
+		}
+
+		allowed := o.getUserPolicy(policy.User, entryGroups(policy))
+		if policy.DefaultTenant != "" && !allowed.allowsTenant(policy.DefaultTenant) {
+			problem(".DefaultTenant", "tenant '%s' not in the allowed tenants '%s'",
+				policy.DefaultTenant, allowed.Tenants)
+		}
+		if policy.DefaultNetwork != "" && !allowed.Networks.allows(policy.DefaultNetwork) {
+			problem(".DefaultNetwork", "network '%s' not in the allowed networks '%s'",
+				policy.DefaultNetwork, allowed.Networks)
+		}
+		if policy.DefaultNetworkPolicy != "" {
+			if !policyNames[policy.DefaultNetworkPolicy] {
+				problem(".DefaultNetworkPolicy", "undefined policy '%s'", policy.DefaultNetworkPolicy)
+			} else if !allowed.NetworkPolicies.allows(policy.DefaultNetworkPolicy) {
+				problem(".DefaultNetworkPolicy", "policy '%s' not in the allowed policies '%s'",
+					policy.DefaultNetworkPolicy, allowed.NetworkPolicies)
+			}
+		}
+	}
+
+	return problems
+}
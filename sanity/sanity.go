@@ -395,7 +395,7 @@ func disallowedPolicyTest() error {
 	return nil
 }
 
-func inconsistentNetworkInfoTest() error {
+func multiNetworkTest() error {
 	yamlData := []byte(`
         web:
           image: web
@@ -414,10 +414,12 @@ func inconsistentNetworkInfoTest() error {
 	}
 	defer removeTmpFile()
 
-	projectName := "inconsistent_tenant"
-	if _, err := runComposition(projectName); err == nil {
-		log.Fatalf("Successfully ran inconsistent network config")
+	projectName := "multi_network"
+	if output, err := runComposition(projectName); err != nil {
+		log.Errorf("Error running composition across networks: %s", output)
+		return err
 	}
+	defer stopComposition(projectName)
 
 	log.Infof("  Pass")
 
@@ -560,12 +562,14 @@ func main() {
         "UserPolicy" : [
 
                 { "User":"admin",
+                  "Tenants": "all",
                   "Networks": "all",
                   "DefaultNetwork": "dev",
                   "NetworkPolicies" : "all",
                   "DefaultNetworkPolicy": "AllPriviliges" },
 
                 { "User":"vagrant",
+                  "Tenants": "default,blue",
                   "DefaultTenant": "default",
                   "Networks": "test,dev",
                   "DefaultNetwork": "dev",
@@ -629,9 +633,9 @@ func main() {
 		log.Fatalf("Error in %s: %s", testName, err)
 	}
 
-	testName = "inconsnstent networks"
+	testName = "multiple networks"
 	log.Infof("Running test: %s", testName)
-	if err := inconsistentNetworkInfoTest(); err != nil {
+	if err := multiNetworkTest(); err != nil {
 		log.Fatalf("Error in %s: %s", testName, err)
 	}
 
@@ -650,6 +654,7 @@ func main() {
 
         "UserPolicy" : [
                 { "User":"vagrant",
+                  "Tenants": "default,blue",
                   "DefaultTenant": "default",
                   "Networks": "test,dev",
                   "DefaultNetwork": "dev",